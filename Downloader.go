@@ -1,15 +1,14 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"hash/fnv"
 	"net/url"
 	"os"
 	"path"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/disintegration/imaging"
@@ -25,101 +24,26 @@ func DownloadGallery(requestURL, targetUrl, title string) error {
 func processGalleryPage(requestURL, targetUrl, title string, processedPosts map[string]bool) ([]string, bool, error) {
 	fmt.Printf("Starting processGalleryPage for %s (title: %s)\n", targetUrl, title)
 
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				MaxVersion: tls.VersionTLS13,
-			},
-			ForceAttemptHTTP2: true,
-		},
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			fmt.Printf("Redirecting to %s\n", req.URL.String())
-			return nil
-		},
-	}
-	req, err := http.NewRequest("GET", targetUrl, nil)
+	body, err := fetchForumPage(targetUrl)
 	if err != nil {
-		return nil, false, fmt.Errorf("creating request for %s: %v", targetUrl, err)
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:91.0) Gecko/20100101 Firefox/91.0")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-
-	cookies := []*http.Cookie{
-		{Name: "__ddg1_", Value: "vS9u2qlH1LdLLfFm3ku8"},
-		{Name: "vg_sessionhash", Value: "c89743f0b493d6cbb7768a469c090af1"},
-		{Name: "vg_lastvisit", Value: "1741979231"},
-		{Name: "vg_lastactivity", Value: "0"},
-	}
-	for _, cookie := range cookies {
-		req.AddCookie(cookie)
-	}
-
-	maxRetries := 3
-	var resp *http.Response
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		fmt.Printf("Attempt %d of %d to fetch %s\n", attempt, maxRetries, targetUrl)
-		resp, err = client.Do(req)
-		if err != nil {
-			fmt.Printf("Request failed: %v\n", err)
-			if attempt == maxRetries {
-				return nil, false, fmt.Errorf("fetching %s after %d attempts: %v", targetUrl, maxRetries, err)
-			}
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		break
-	}
-	if resp == nil {
-		return nil, false, fmt.Errorf("no response received for %s after %d attempts", targetUrl, maxRetries)
-	}
-	defer resp.Body.Close()
-
-	fmt.Printf("HTTP response for %s: Status %d\n", targetUrl, resp.StatusCode)
-	if resp.StatusCode != 200 {
-		fmt.Printf("Non-200 status for %s: %d\n", targetUrl, resp.StatusCode)
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("Error reading response body: %v\n", err)
-		}
-		if err := os.WriteFile("response.html", body, 0644); err != nil {
-			fmt.Printf("Error saving response body: %v\n", err)
-		} else {
-			fmt.Println("Saved response body to response.html")
-		}
-		return nil, false, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, targetUrl)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, false, fmt.Errorf("reading response body: %v", err)
-	}
-	if strings.Contains(string(body), "DDoS-Guard") || strings.Contains(string(body), "Checking your browser") {
-		fmt.Println("DDoS-Guard protection detected. Please update cookies from your browser.")
-		if err := os.WriteFile("response.html", body, 0644); err != nil {
-			fmt.Printf("Error saving DDoS-Guard response: %v\n", err)
-		} else {
-			fmt.Println("Saved DDoS-Guard response to response.html")
-		}
-		return nil, false, fmt.Errorf("blocked by DDoS-Guard; update cookies and retry")
+		return nil, false, err
 	}
 
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
 	if err != nil {
 		return nil, false, fmt.Errorf("parsing HTML from %s: %v", targetUrl, err)
 	}
+	return processGalleryDocument(requestURL, targetUrl, title, doc, processedPosts)
+}
 
-	// Determine the main gallery folder (strip /pageN and #post)
-	mainUrl := targetUrl
-	if idx := strings.Index(mainUrl, "/page"); idx != -1 {
-		mainUrl = mainUrl[:idx]
-	}
-	if idx := strings.Index(mainUrl, "#"); idx != -1 {
-		mainUrl = mainUrl[:idx]
-	}
+// processGalleryDocument downloads the images of the post targetUrl refers to
+// from an already parsed page, whether fetched by us or ingested from a browser.
+func processGalleryDocument(requestURL, targetUrl, title string, doc *goquery.Document, processedPosts map[string]bool) ([]string, bool, error) {
+	src := sourceFor(targetUrl)
+	fmt.Printf("Using %s source for %s\n", src.Name(), targetUrl)
+
+	// Determine the main gallery folder (strip paging and post anchors)
+	mainUrl := src.ThreadURL(targetUrl)
 	u, err := url.Parse(mainUrl)
 	if err != nil {
 		return nil, false, fmt.Errorf("parsing URL %s: %v", mainUrl, err)
@@ -131,21 +55,12 @@ func processGalleryPage(requestURL, targetUrl, title string, processedPosts map[
 	}
 
 	// Get post ID for subfolder
-	postId := ""
-	if strings.Contains(targetUrl, "#post") {
-		split := strings.Split(targetUrl, "#post")
-		postId = "post" + split[len(split)-1]
-	}
+	postId := src.PostIDFromURL(targetUrl)
 	if postId == "" {
-		// fallback: try to find the first post_message_ div
-		doc.Find("div[id^='post_message_']").EachWithBreak(func(_ int, s *goquery.Selection) bool {
-			id, exists := s.Attr("id")
-			if exists {
-				postId = id
-				return false // break
-			}
-			return true
-		})
+		// fallback: use the first post on the page
+		if posts := src.Posts(doc, targetUrl); len(posts) > 0 {
+			postId = posts[0].ID
+		}
 	}
 	if postId == "" {
 		return nil, false, fmt.Errorf("could not determine post ID for %s", targetUrl)
@@ -163,103 +78,303 @@ func processGalleryPage(requestURL, targetUrl, title string, processedPosts map[
 	}
 	fmt.Printf("Directory %s and thumbnail dir %s created or already exist\n", directory, thumbnailDir)
 
+	requestID, err := requestIDForURL(requestURL)
+	if err != nil {
+		return nil, false, err
+	}
+
 	var newPostIDs []string
 	done := false
+	downloaded, failed := 0, 0
 
-	isFirstMatch := true
-	doc.Find(fmt.Sprintf("div[id^='%s']", postId)).Each(func(_ int, s *goquery.Selection) {
-		if !isFirstMatch {
-			fmt.Println("Skipping additional matches for this post ID")
-			return
+	post, found := src.FindPost(doc, postId)
+	// Relative links in the post resolve against the page it is on.
+	post.URL = targetUrl
+	switch {
+	case !found:
+		fmt.Printf("Post %s not found on %s\n", postId, targetUrl)
+	case processedPosts != nil && processedPosts[post.ID]:
+		fmt.Printf("Already processed post %s, stopping.\n", post.ID)
+		done = true
+	default:
+		newPostIDs = append(newPostIDs, post.ID)
+		if err := saveGalleryMetadata(requestID, requestURL, src.PostMeta(doc, post)); err != nil {
+			fmt.Printf("Error saving post metadata: %v\n", err)
 		}
-		// Get the actual post ID from the div
-		divID, exists := s.Attr("id")
-		if exists {
-			if processedPosts != nil && processedPosts[divID] {
-				fmt.Printf("Already processed post %s, stopping.\n", divID)
-				done = true
-				return
+		fmt.Printf("Found matching post for %s, parsing images\n", postId)
+		links := src.PostLinks(post)
+		fmt.Printf("Detected %d potential image links\n", len(links))
+		downloaded, failed = downloadPostLinks(requestID, requestURL, links, directory)
+	}
+
+	fmt.Printf("Completed processing for %s: %d images ok, %d failed\n", targetUrl, downloaded, failed)
+	if failed > 0 {
+		return newPostIDs, done, fmt.Errorf("%d of %d images failed for %s: %w", failed, downloaded+failed, targetUrl, ErrIncompleteGallery)
+	}
+	return newPostIDs, done, nil
+}
+
+// postDownloadWorkers bounds how many links of one post are ripped and
+// downloaded at once. Per-host limits still apply on top of it.
+var postDownloadWorkers = envInt("POST_DOWNLOAD_WORKERS", 4)
+
+// downloadPostLinks rips and downloads the links of a post with a bounded
+// pool of workers. An album's items join the same pool as links of their own.
+// Results are recorded in link order, album items in place of their album, as
+// soon as every earlier link is done, so photos are stored in the order of
+// the post. It returns once every image has succeeded or failed.
+func downloadPostLinks(requestID int, requestURL string, links []PostLink, directory string) (int, int) {
+	workers := make(chan struct{}, max(postDownloadWorkers, 1))
+	var seenMu sync.Mutex
+	seen := make(map[string]bool, len(links))
+	for _, link := range links {
+		seen[link.Href] = true
+	}
+
+	var start func(link PostLink, depth int) *linkTask
+	start = func(link PostLink, depth int) *linkTask {
+		task := &linkTask{done: make(chan struct{})}
+		go func() {
+			workers <- struct{}{}
+			fmt.Printf("Found link %s\n", link.Href)
+			results, items := resolveLink(requestID, link, directory, depth)
+			<-workers
+			task.results = results
+			seenMu.Lock()
+			for _, item := range items {
+				if seen[item.Href] {
+					continue
+				}
+				seen[item.Href] = true
+				task.items = append(task.items, start(item, depth+1))
 			}
-			newPostIDs = append(newPostIDs, divID)
+			seenMu.Unlock()
+			close(task.done)
+		}()
+		return task
+	}
+	tasks := make([]*linkTask, len(links))
+	for i, link := range links {
+		tasks[i] = start(link, 0)
+	}
+
+	downloaded, failed := 0, 0
+	var record func(task *linkTask)
+	record = func(task *linkTask) {
+		<-task.done
+		ok, bad := recordImageResults(requestURL, task.results)
+		downloaded += ok
+		failed += bad
+		for _, item := range task.items {
+			record(item)
 		}
-		fmt.Printf("Found matching div for %s, parsing images\n", postId)
-		count := s.Find("a img").Length()
-		fmt.Printf("Detected %d potential image links\n", count)
-		s.Find("a img").Each(func(i int, img *goquery.Selection) {
-			if img.AttrOr("alt", "") == "View Post" {
-				fmt.Printf("Skipping element %d: alt='View Post'\n", i)
-				return
-			}
-			a := img.Parent()
-			src, exists := a.Attr("href")
-			if !exists {
-				fmt.Printf("Element %d: No href found\n", i)
-				return
-			}
-			fmt.Printf("Element %d: Found link %s\n", i, src)
-			var imageURL string
-			switch {
-			case strings.Contains(src, "imagebam"):
-				fmt.Println("Ripping from ImageBam")
-				imageURL, _ = RipImageBam(src)
-			case strings.Contains(src, "imgbox"):
-				fmt.Println("Ripping from ImgBox")
-				imageURL, _ = RipImageBox(src)
-			case strings.Contains(src, "imx.to"):
-				fmt.Println("Ripping from Imx.to")
-				imageURL, _ = RipImx(img.AttrOr("src", ""))
-			case strings.Contains(src, "turboimagehost"):
-				fmt.Println("Ripping from TurboImageHost")
-				imageURL, _ = RipTurboImg(src)
-			case strings.Contains(src, "vipr.im"):
-				fmt.Println("Ripping from Vipr.im")
-				imageURL, _ = RipViprIm(img.AttrOr("src", ""))
-			case strings.Contains(src, "pixhost"):
-				fmt.Println("Ripping from PixHost")
-				imageURL, _ = RipPixHost(img.AttrOr("src", ""))
-			case strings.Contains(src, "acidimg"):
-				fmt.Println("Ripping from AcidImg")
-				imageURL, _ = RipAcidImg(img.AttrOr("src", ""))
-			case strings.Contains(src, "postimages.org"):
-				fmt.Println("Ripping from PostImages")
-				imageURL, _ = RipPostImages(src)
-			case strings.Contains(src, "pixxxels.cc") || strings.Contains(src, "freeimage.us"):
-				fmt.Printf("Skipping unsupported host: %s\n", src)
-				return
-			default:
-				fmt.Printf("Unknown image source %s on %s\n", src, targetUrl)
-				return
-			}
-			if imageURL != "" {
-				filename := path.Base(imageURL)
-				filepath := fmt.Sprintf("%s/%s", directory, filename)
-				thumbnailPath := fmt.Sprintf("%s/thumb_%s", thumbnailDir, filename)
-				if _, err := os.Stat(filepath); os.IsNotExist(err) {
-					if err := DownloadFile(imageURL, filepath); err != nil {
-						fmt.Printf("Error downloading %s: %v\n", imageURL, err)
-					} else {
-						if err := generateThumbnail(filepath, thumbnailPath); err != nil {
-							fmt.Printf("Error generating thumbnail: %v\n", err)
-						} else {
-							if err := storePhoto(requestURL, imageURL, filepath, thumbnailPath); err != nil {
-								fmt.Printf("Failed to store photo: %v\n", err)
-							}
-						}
-					}
-				}
+	}
+	for _, task := range tasks {
+		record(task)
+	}
+	return downloaded, failed
+}
+
+// linkTask is one link in the download pool. items are the tasks of the
+// album items it expanded into, in album order.
+type linkTask struct {
+	done    chan struct{}
+	results []imageResult
+	items   []*linkTask
+}
+
+// imageResult is the outcome of one image link, recorded by
+// recordImageResults. photo is set for a new download still to be stored.
+// expanded marks an album link that expanded into items: recording it only
+// clears the album's earlier failure and does not count as an image.
+type imageResult struct {
+	attempt  PhotoAttempt
+	photo    *downloadedImage
+	expanded bool
+}
+
+type downloadedImage struct {
+	filePath      string
+	thumbnailPath string
+	mediaType     string
+	sha256        string
+	fingerprint   *imageFingerprint // nil when the file could not be decoded
+}
+
+// ripAndDownload resolves one post link and downloads every image behind it
+// into directory, recording an attempt for each. It returns how many images
+// were stored and how many failed.
+func ripAndDownload(requestID int, requestURL string, link PostLink, directory string) (int, int) {
+	return downloadPostLinks(requestID, requestURL, []PostLink{link}, directory)
+}
+
+// recordImageResults stores the new photos and records the attempts, in order.
+func recordImageResults(requestURL string, results []imageResult) (int, int) {
+	ok, failed := 0, 0
+	for _, r := range results {
+		if r.expanded {
+			clearRipFailure(r.attempt.RequestID, r.attempt.LinkURL)
+			continue
+		}
+		if r.photo != nil {
+			if err := storePhoto(requestURL, r.attempt.ImageURL, r.photo); err != nil {
+				r.attempt.Status = attemptFailed
+				r.attempt.LastError = fmt.Sprintf("storing photo: %v", err)
 			}
-		})
-		isFirstMatch = false
-	})
+		}
+		recordAttempt(r.attempt)
+		if r.attempt.Status == attemptDownloaded {
+			ok++
+		} else {
+			failed++
+		}
+	}
+	return ok, failed
+}
 
-	fmt.Printf("Completed processing for %s\n", targetUrl)
-	return newPostIDs, done, nil
+// maxAlbumDepth bounds how deep albums nested in albums are followed.
+const maxAlbumDepth = 3
+
+// resolveLink rips one link found depth albums down and downloads every image
+// behind it into directory without touching the database. An album is not
+// downloaded here: its items are returned to be resolved as links of their
+// own.
+func resolveLink(requestID int, link PostLink, directory string, depth int) ([]imageResult, []PostLink) {
+	attempt := PhotoAttempt{RequestID: requestID, LinkURL: link.Href, ThumbURL: link.Thumb, PostDir: directory}
+	ripper := findRipper(link)
+	if ripper == nil {
+		fmt.Printf("Unknown image source %s\n", link.Href)
+		attempt.Status = attemptUnsupported
+		attempt.LastError = "no ripper matches this link"
+		return []imageResult{{attempt: attempt}}, nil
+	}
+	attempt.Ripper = ripper.Name()
+	attempt.Fallback = isFallbackRipper(ripper)
+	if album, ok := ripper.(AlbumRipper); ok {
+		if depth >= maxAlbumDepth {
+			attempt.Status = attemptUnsupported
+			attempt.LastError = fmt.Sprintf("album nested more than %d deep", maxAlbumDepth)
+			return []imageResult{{attempt: attempt}}, nil
+		}
+		items, err := album.Expand(link)
+		if err != nil {
+			fmt.Printf("Error expanding album %s: %v\n", link.Href, err)
+			attempt.Status = failedStatus(hostOf(link.Href), err)
+			attempt.LastError = err.Error()
+			return []imageResult{{attempt: attempt}}, nil
+		}
+		return []imageResult{{attempt: attempt, expanded: true}}, items
+	}
+	fmt.Printf("Ripping from %s\n", ripper.Name())
+	imageURLs, err := ripper.Rip(link)
+	if err == nil && len(imageURLs) == 0 {
+		err = fmt.Errorf("%s returned no images", ripper.Name())
+	}
+	if err != nil {
+		fmt.Printf("Error ripping %s with %s: %v\n", link.Href, ripper.Name(), err)
+		attempt.Status = failedStatus(hostOf(link.Href), err)
+		attempt.LastError = err.Error()
+		return []imageResult{{attempt: attempt}}, nil
+	}
+	results := make([]imageResult, 0, len(imageURLs))
+	for _, imageURL := range imageURLs {
+		attempt.ImageURL = imageURL
+		results = append(results, fetchImage(attempt))
+	}
+	return results, nil
+}
+
+// downloadAttempt downloads the resolved image of attempt into its post
+// directory and records the outcome.
+func downloadAttempt(requestURL string, attempt PhotoAttempt) bool {
+	ok, _ := recordImageResults(requestURL, []imageResult{fetchImage(attempt)})
+	return ok > 0
+}
+
+// fetchImage downloads the image of a resolved attempt.
+func fetchImage(attempt PhotoAttempt) imageResult {
+	filePath, photo, err := downloadImage(attempt.ImageURL, attempt.PostDir)
+	attempt.FilePath = filePath
+	if err != nil {
+		fmt.Printf("Error downloading %s: %v\n", attempt.ImageURL, err)
+		attempt.Status = failedStatus(hostOf(attempt.ImageURL), err)
+		attempt.LastError = err.Error()
+		return imageResult{attempt: attempt}
+	}
+	attempt.Status = attemptDownloaded
+	attempt.LastError = ""
+	return imageResult{attempt: attempt, photo: photo}
+}
+
+// failedStatus is the attempt status for err: invalid content, deferred while
+// host is skipped by its circuit breaker, or plain failed. The failure that
+// opens the circuit is deferred too, so it is retried with the rest.
+func failedStatus(host string, err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidContent):
+		return attemptInvalid
+	case errors.Is(err, ErrHostUnavailable), hostCircuitOpen(host):
+		return attemptDeferred
+	}
+	return attemptFailed
+}
+
+// downloadPathLocks serialise downloads to the same file, e.g. two links of a
+// post whose images share a file name. Paths are spread over a fixed set of
+// locks.
+var downloadPathLocks [64]sync.Mutex
+
+func downloadPathLock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return &downloadPathLocks[h.Sum32()%uint32(len(downloadPathLocks))]
+}
+
+// downloadImage fetches imageURL into directory unless it is already present,
+// links it to an identical stored copy if there is one, then thumbnails and
+// fingerprints it. The returned photo is nil when the file was already there.
+func downloadImage(imageURL, directory string) (string, *downloadedImage, error) {
+	filename := path.Base(imageURL)
+	filepath := fmt.Sprintf("%s/%s", directory, filename)
+	thumbnailDir := directory + "/thumbnails"
+	thumbnailPath := fmt.Sprintf("%s/thumb_%s", thumbnailDir, filename)
+
+	lock := downloadPathLock(filepath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if fileDownloaded(filepath) {
+		return filepath, nil, nil
+	}
+	if err := os.MkdirAll(thumbnailDir, os.ModePerm); err != nil {
+		return filepath, nil, fmt.Errorf("creating thumbnail directory %s: %v", thumbnailDir, err)
+	}
+	sum, err := DownloadFile(imageURL, filepath)
+	if err != nil {
+		return filepath, nil, err
+	}
+	dedupeFile(filepath, sum)
+	mediaType, err := detectMediaType(filepath)
+	if err != nil {
+		return filepath, nil, err
+	}
+	thumbnailPath, err = generateMediaThumbnail(filepath, thumbnailPath, mediaType)
+	if err != nil {
+		return filepath, nil, err
+	}
+	photo := &downloadedImage{filePath: filepath, thumbnailPath: thumbnailPath, mediaType: mediaType, sha256: sum}
+	if mediaType != mediaVideo {
+		if photo.fingerprint, err = fingerprintImage(filepath); err != nil {
+			fmt.Printf("Not fingerprinting %s: %v\n", filepath, err)
+		}
+	}
+	return filepath, photo, nil
 }
 
 func generateThumbnail(srcPath, destPath string) error {
 	img, err := imaging.Open(srcPath)
 	if err != nil {
-		return fmt.Errorf("opening image %s: %v", srcPath, err)
+		return fmt.Errorf("opening image %s: %w", srcPath, err)
 	}
 
 	// Resize to width 200, maintaining aspect ratio
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubRipper fails every link after an optional delay, so only the recorded
+// attempts are left to look at. Links on album.test expand into items.
+type stubRipper struct {
+	delays map[string]time.Duration
+	albums map[string][]PostLink
+}
+
+func (stubRipper) Name() string { return "stub" }
+
+func (stubRipper) Match(link PostLink) bool {
+	return strings.HasPrefix(link.Href, "https://stub.test/") || strings.HasPrefix(link.Href, "https://album.test/")
+}
+
+func (r stubRipper) Rip(link PostLink) ([]string, error) {
+	time.Sleep(r.delays[link.Href])
+	return nil, errors.New("stub ripper")
+}
+
+type stubAlbumRipper struct{ stubRipper }
+
+func (r stubAlbumRipper) Match(link PostLink) bool {
+	_, ok := r.albums[link.Href]
+	return ok
+}
+
+func (r stubAlbumRipper) Name() string { return "stub-album" }
+
+func (r stubAlbumRipper) Expand(link PostLink) ([]PostLink, error) {
+	time.Sleep(r.delays[link.Href])
+	return r.albums[link.Href], nil
+}
+
+func TestDownloadPostLinksOrder(t *testing.T) {
+	useTestDB(t)
+	links := func(hrefs ...string) []PostLink {
+		var out []PostLink
+		for _, h := range hrefs {
+			out = append(out, PostLink{Href: h})
+		}
+		return out
+	}
+	stub := stubRipper{
+		// Earlier links finish last, so the pool completes them out of order.
+		delays: map[string]time.Duration{
+			"https://stub.test/1":  60 * time.Millisecond,
+			"https://album.test/a": 30 * time.Millisecond,
+			"https://stub.test/a1": 20 * time.Millisecond,
+		},
+		albums: map[string][]PostLink{
+			// A link already in the post and a repeated item are skipped.
+			"https://album.test/a": links("https://stub.test/a1", "https://stub.test/2", "https://stub.test/a1", "https://stub.test/a2"),
+		},
+	}
+	RegisterRipper(stubAlbumRipper{stub}, -2)
+	RegisterRipper(stub, -1)
+	t.Cleanup(func() {
+		unregisterRipper("stub-album")
+		unregisterRipper("stub")
+	})
+
+	const requestID = 1
+	downloaded, failed := downloadPostLinks(requestID, "https://forum.test/post1",
+		links("https://stub.test/1", "https://album.test/a", "https://stub.test/2", "https://stub.test/3"), t.TempDir())
+	if downloaded != 0 || failed != 5 {
+		t.Errorf("downloadPostLinks = %d, %d; want 0, 5", downloaded, failed)
+	}
+
+	rows, err := db.Query("SELECT link_url FROM photo_attempts WHERE request_id = ? ORDER BY id", requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var link string
+		if err := rows.Scan(&link); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, link)
+	}
+	want := []string{
+		"https://stub.test/1",
+		"https://stub.test/a1",
+		"https://stub.test/a2",
+		"https://stub.test/2",
+		"https://stub.test/3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attempts recorded in order %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// maxAlbumPages caps how many pages of a host-side gallery are followed.
+const maxAlbumPages = 50
+
+// AlbumRipper is implemented by rippers whose links point at a gallery of
+// images rather than a single image. Expand returns one link per image, which
+// are then resolved by the single-image rippers.
+type AlbumRipper interface {
+	Ripper
+	Expand(link PostLink) ([]PostLink, error)
+}
+
+// pagedAlbumRipper walks a paginated gallery page on an image host and
+// collects the link to every image on it.
+type pagedAlbumRipper struct {
+	name     string
+	patterns []string
+	itemSel  string // anchors pointing at each image page
+	nextSel  string // anchor for the next gallery page
+}
+
+func init() {
+	registerBuiltinAlbum(&pagedAlbumRipper{
+		name:     "imgbox-album",
+		patterns: []string{"imgbox.com/g/"},
+		itemSel:  "#gallery-view-content a",
+		nextSel:  "a[rel='next']",
+	})
+	registerBuiltinAlbum(&pagedAlbumRipper{
+		name:     "imagebam-album",
+		patterns: []string{"imagebam.com/gallery/", "imagebam.com/view/G"},
+		itemSel:  "a[href*='/view/M'], a[href*='/image/']",
+		nextSel:  "a[rel='next'], .pagination a.next",
+	})
+}
+
+// registerBuiltinAlbum registers an album ripper ahead of the single-image
+// rippers for the same host.
+func registerBuiltinAlbum(r AlbumRipper) {
+	builtinRippers[r.Name()] = r
+	RegisterRipper(r, -10)
+}
+
+func (a *pagedAlbumRipper) Name() string { return a.name }
+
+func (a *pagedAlbumRipper) Match(link PostLink) bool {
+	for _, p := range a.patterns {
+		if strings.Contains(link.Href, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *pagedAlbumRipper) Expand(link PostLink) ([]PostLink, error) {
+	fmt.Printf("Expanding %s album %s\n", a.name, link.Href)
+	var items []PostLink
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+
+	var next string
+	c := newCollector()
+	c.OnHTML(a.itemSel, func(e *colly.HTMLElement) {
+		href := e.Request.AbsoluteURL(e.Attr("href"))
+		if href == "" || href == link.Href || seen[href] {
+			return
+		}
+		seen[href] = true
+		thumb := e.ChildAttr("img", "src")
+		if thumb != "" {
+			thumb = e.Request.AbsoluteURL(thumb)
+		}
+		items = append(items, PostLink{Href: href, Thumb: thumb})
+	})
+	c.OnHTML(a.nextSel, func(e *colly.HTMLElement) {
+		if next == "" {
+			next = e.Request.AbsoluteURL(e.Attr("href"))
+		}
+	})
+
+	pageURL := link.Href
+	for page := 1; page <= maxAlbumPages && pageURL != "" && !visited[pageURL]; page++ {
+		visited[pageURL] = true
+		next = ""
+		before := len(items)
+		if err := c.Visit(pageURL); err != nil {
+			if page == 1 {
+				return nil, fmt.Errorf("visiting %s album %s: %v", a.name, pageURL, err)
+			}
+			fmt.Printf("Stopping %s album at page %d: %v\n", a.name, page, err)
+			break
+		}
+		fmt.Printf("Album page %d of %s: %d images\n", page, link.Href, len(items)-before)
+		if len(items) == before {
+			break
+		}
+		pageURL = next
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no images found in %s album %s", a.name, link.Href)
+	}
+	return items, nil
+}
+
+// Rip resolves every image of the album through the registry. The download
+// pipeline uses Expand instead so each image gets its own attempt record.
+func (a *pagedAlbumRipper) Rip(link PostLink) ([]string, error) {
+	items, err := a.Expand(link)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, item := range items {
+		r := findRipper(item)
+		if r == nil {
+			continue
+		}
+		if _, isAlbum := r.(AlbumRipper); isAlbum {
+			continue
+		}
+		resolved, err := r.Rip(item)
+		if err != nil {
+			fmt.Printf("Error ripping album item %s: %v\n", item.Href, err)
+			continue
+		}
+		urls = append(urls, resolved...)
+	}
+	return urls, nil
+}
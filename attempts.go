@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attempt statuses stored in photo_attempts.status.
+const (
+	attemptDownloaded  = "downloaded"
+	attemptFailed      = "failed"
+	attemptUnsupported = "unsupported"
+	attemptInvalid     = "invalid"  // downloaded, but not a real image (see ErrInvalidContent)
+	attemptDeferred    = "deferred" // skipped while the host's circuit was open (see ErrHostUnavailable)
+)
+
+// ErrIncompleteGallery is returned (wrapped) when a post was processed but
+// some of its images could not be ripped or downloaded.
+var ErrIncompleteGallery = errors.New("some images could not be downloaded")
+
+// PhotoAttempt records what happened to one image link found in a post.
+type PhotoAttempt struct {
+	ID        int    `json:"id"`
+	RequestID int    `json:"requestId"`
+	LinkURL   string `json:"linkUrl"`
+	ThumbURL  string `json:"thumbUrl,omitempty"`
+	Ripper    string `json:"ripper,omitempty"`
+	Fallback  bool   `json:"fallback"` // resolved by the generic ripper
+	ImageURL  string `json:"imageUrl,omitempty"`
+	FilePath  string `json:"filePath,omitempty"`
+	PostDir   string `json:"-"`
+	Status    string `json:"status"`
+	LastError string `json:"lastError,omitempty"`
+	Attempts  int    `json:"attempts"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func recordAttempt(a PhotoAttempt) {
+	_, err := execWithRetry(`
+		INSERT INTO photo_attempts (request_id, link_url, thumb_url, ripper, fallback, image_url, file_path, post_dir, status, last_error, attempts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT (request_id, link_url, image_url) DO UPDATE SET
+			ripper = excluded.ripper,
+			fallback = excluded.fallback,
+			file_path = excluded.file_path,
+			post_dir = excluded.post_dir,
+			status = excluded.status,
+			last_error = excluded.last_error,
+			attempts = photo_attempts.attempts + 1,
+			updated_at = CURRENT_TIMESTAMP`,
+		a.RequestID, a.LinkURL, a.ThumbURL, a.Ripper, a.Fallback, a.ImageURL, a.FilePath, a.PostDir, a.Status, a.LastError)
+	if err != nil {
+		log.Printf("Failed to record attempt for %s: %v", a.LinkURL, err)
+	}
+	if a.ImageURL != "" {
+		clearRipFailure(a.RequestID, a.LinkURL)
+	}
+}
+
+// clearRipFailure drops the row of a link that failed to resolve once it
+// resolves, to an image or to the items of an album.
+func clearRipFailure(requestID int, linkURL string) {
+	_, _ = execWithRetry("DELETE FROM photo_attempts WHERE request_id = ? AND link_url = ? AND image_url = ''", requestID, linkURL)
+}
+
+func scanAttempts(rows *sql.Rows) ([]PhotoAttempt, error) {
+	var attempts []PhotoAttempt
+	for rows.Next() {
+		var a PhotoAttempt
+		var thumb, ripper, filePath, postDir, lastError sql.NullString
+		if err := rows.Scan(&a.ID, &a.RequestID, &a.LinkURL, &thumb, &ripper, &a.Fallback, &a.ImageURL, &filePath, &postDir,
+			&a.Status, &lastError, &a.Attempts, &a.UpdatedAt); err != nil {
+			return nil, err
+		}
+		a.ThumbURL = thumb.String
+		a.Ripper = ripper.String
+		a.FilePath = filePath.String
+		a.PostDir = postDir.String
+		a.LastError = lastError.String
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+const attemptColumns = `id, request_id, link_url, thumb_url, ripper, fallback, image_url, file_path, post_dir,
+	status, last_error, attempts, updated_at`
+
+func failedAttempts(requestID int) ([]PhotoAttempt, error) {
+	rows, err := db.Query(`SELECT `+attemptColumns+` FROM photo_attempts
+		WHERE request_id = ? AND status IN (?, ?, ?, ?) ORDER BY id`, requestID, attemptFailed, attemptUnsupported, attemptInvalid, attemptDeferred)
+	if err != nil {
+		return nil, fmt.Errorf("querying failed attempts for request %d: %v", requestID, err)
+	}
+	defer rows.Close()
+	return scanAttempts(rows)
+}
+
+// retryFailedAttempts re-runs every failed, unsupported, invalid or deferred
+// link of a request.
+func retryFailedAttempts(requestID int) error {
+	attempts, err := failedAttempts(requestID)
+	if err != nil {
+		return err
+	}
+	return retryAttempts(requestID, attempts)
+}
+
+// ErrRetryInProgress is returned when a request's images are already being
+// retried.
+var ErrRetryInProgress = errors.New("a retry of this request is already running")
+
+var (
+	retryingMu sync.Mutex
+	retrying   = make(map[int]bool)
+)
+
+// retryAttempts re-runs attempts of one request. Links that never resolved
+// are ripped again; resolved images are only re-downloaded. A finished
+// request is then marked completed or incomplete by what is left failing;
+// one being processed or failed for other reasons keeps its status.
+func retryAttempts(requestID int, attempts []PhotoAttempt) error {
+	retryingMu.Lock()
+	if retrying[requestID] {
+		retryingMu.Unlock()
+		return ErrRetryInProgress
+	}
+	retrying[requestID] = true
+	retryingMu.Unlock()
+	defer func() {
+		retryingMu.Lock()
+		delete(retrying, requestID)
+		retryingMu.Unlock()
+	}()
+
+	var requestURL string
+	if err := db.QueryRow("SELECT url FROM requests WHERE id = ?", requestID).Scan(&requestURL); err != nil {
+		return fmt.Errorf("querying request %d: %v", requestID, err)
+	}
+	for _, a := range attempts {
+		if a.PostDir == "" {
+			log.Printf("Skipping attempt %d: no post directory recorded", a.ID)
+			continue
+		}
+		link := PostLink{Href: a.LinkURL, Thumb: a.ThumbURL}
+		if a.ImageURL == "" {
+			ripAndDownload(requestID, requestURL, link, a.PostDir)
+			continue
+		}
+		downloadAttempt(requestURL, a)
+	}
+	remaining, err := failedAttempts(requestID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Retried %d attempts for request %d, %d still failing", len(attempts), requestID, len(remaining))
+
+	var status sql.NullString
+	if err := db.QueryRow("SELECT status FROM requests WHERE id = ?", requestID).Scan(&status); err != nil {
+		return fmt.Errorf("querying status of request %d: %v", requestID, err)
+	}
+	if status.String != "completed" && status.String != "incomplete" {
+		return nil
+	}
+	var result error
+	if len(remaining) > 0 {
+		result = fmt.Errorf("%d images still failing: %w", len(remaining), ErrIncompleteGallery)
+	}
+	finishRequest(requestID, requestURL, result)
+	return nil
+}
+
+func listRequestAttempts(c *gin.Context) {
+	requestID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+	rows, err := db.Query(`SELECT `+attemptColumns+` FROM photo_attempts WHERE request_id = ? ORDER BY id`, requestID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	attempts, err := scanAttempts(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if attempts == nil {
+		attempts = []PhotoAttempt{}
+	}
+	c.JSON(http.StatusOK, attempts)
+}
+
+func retryRequest(c *gin.Context) {
+	requestID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+	// A failed ingest has no page left to retry from, so the whole request
+	// goes back to the queue instead.
+	requeued, err := requeueIngested(requestID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if requeued {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Request re-queued"})
+		return
+	}
+	attempts, err := failedAttempts(requestID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(attempts) == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "No failed images to retry", "queued": 0})
+		return
+	}
+	retryingMu.Lock()
+	busy := retrying[requestID]
+	retryingMu.Unlock()
+	if busy {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrRetryInProgress.Error()})
+		return
+	}
+	go func() {
+		if err := retryFailedAttempts(requestID); err != nil {
+			log.Printf("Retry of request %d failed: %v", requestID, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"message": "Retry started", "queued": len(attempts)})
+}
+
+type IncompleteGallery struct {
+	RequestID   int    `json:"requestId"`
+	GalleryID   *int   `json:"galleryId,omitempty"`
+	Name        string `json:"name,omitempty"`
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Downloaded  int    `json:"downloaded"`
+	Failed      int    `json:"failed"`
+	Unsupported int    `json:"unsupported"`
+	Invalid     int    `json:"invalid"`
+	Deferred    int    `json:"deferred"`
+}
+
+func listIncompleteGalleries(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT r.id, r.url, COALESCE(r.status, ''), g.id, g.name,
+		       a.downloaded, a.failed, a.unsupported, a.invalid, a.deferred
+		FROM (
+			SELECT request_id,
+			       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS downloaded,
+			       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS failed,
+			       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS unsupported,
+			       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS invalid,
+			       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS deferred
+			FROM photo_attempts
+			GROUP BY request_id
+		) a
+		JOIN requests r ON r.id = a.request_id
+		-- Counted before joining: a request can have several gallery rows.
+		LEFT JOIN (SELECT request_id, MIN(id) AS id FROM galleries GROUP BY request_id) fg ON fg.request_id = r.id
+		LEFT JOIN galleries g ON g.id = fg.id
+		WHERE a.failed > 0 OR a.unsupported > 0 OR a.invalid > 0 OR a.deferred > 0
+		ORDER BY r.id DESC`, attemptDownloaded, attemptFailed, attemptUnsupported, attemptInvalid, attemptDeferred)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	galleries := []IncompleteGallery{}
+	for rows.Next() {
+		var g IncompleteGallery
+		var galleryID sql.NullInt64
+		var name sql.NullString
+		if err := rows.Scan(&g.RequestID, &g.URL, &g.Status, &galleryID, &name, &g.Downloaded, &g.Failed, &g.Unsupported, &g.Invalid, &g.Deferred); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if galleryID.Valid {
+			id := int(galleryID.Int64)
+			g.GalleryID = &id
+		}
+		g.Name = name.String
+		galleries = append(galleries, g)
+	}
+	c.JSON(http.StatusOK, galleries)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrHostUnavailable is returned (wrapped) by the shared transport while a
+// host's circuit is open. Attempts that fail this way are recorded as
+// deferred and re-queued once the host answers again.
+var ErrHostUnavailable = errors.New("host is unavailable")
+
+// Breaker settings: the circuit opens after breakerThreshold consecutive
+// failures and stays open for the cooldown, which doubles after each failed
+// probe up to breakerMaxCooldown.
+var (
+	breakerThreshold   = envInt("BREAKER_FAILURE_THRESHOLD", 5)
+	breakerCooldown    = envSeconds("BREAKER_COOLDOWN_SECONDS", time.Minute)
+	breakerMaxCooldown = envSeconds("BREAKER_MAX_COOLDOWN_SECONDS", 30*time.Minute)
+)
+
+// Circuit states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open" // one probe request is in flight
+)
+
+type hostBreaker struct {
+	state     string
+	failures  int // consecutive
+	cooldown  time.Duration
+	openedAt  time.Time
+	retryAt   time.Time
+	lastError string
+	probeURL  string // a URL that failed, used by the background prober
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*hostBreaker)
+)
+
+// onHostRecovered runs in the background when a host's circuit closes after a
+// successful request. Tests replace it to keep the database out of the way.
+var onHostRecovered = retryDeferredAttempts
+
+// breakerFor returns host's breaker, creating it; callers hold breakersMu.
+// Healthy hosts have no entry.
+func breakerFor(host string) *hostBreaker {
+	b, ok := breakers[host]
+	if !ok {
+		b = &hostBreaker{state: circuitClosed}
+		breakers[host] = b
+	}
+	return b
+}
+
+// breakerAllow reports whether a request to host may go out. Once the
+// cooldown has passed, a single request is let through as a probe; probe is
+// true for that request.
+func breakerAllow(host string) (probe bool, err error) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		return false, nil
+	}
+	switch b.state {
+	case circuitOpen:
+		if time.Now().Before(b.retryAt) {
+			return false, fmt.Errorf("%w: %s (circuit open until %s after: %s)", ErrHostUnavailable, host, b.retryAt.Format(time.TimeOnly), b.lastError)
+		}
+		b.state = circuitHalfOpen
+		return true, nil
+	case circuitHalfOpen:
+		return false, fmt.Errorf("%w: %s (waiting for probe)", ErrHostUnavailable, host)
+	}
+	return false, nil
+}
+
+// breakerProbeAbandoned reopens host's circuit when its probe never went out,
+// e.g. because the request was cancelled while waiting for a slot. It counts
+// no failure and lets the next request probe straight away.
+func breakerProbeAbandoned(host string) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[host]; ok && b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.retryAt = time.Now()
+	}
+}
+
+// breakerRecord feeds the outcome of a request to host into its breaker.
+// failure is "" for a healthy response.
+func breakerRecord(host, rawURL, failure string) {
+	breakersMu.Lock()
+	if failure == "" {
+		b, ok := breakers[host]
+		recovered := ok && b.state != circuitClosed
+		delete(breakers, host)
+		breakersMu.Unlock()
+		if recovered {
+			log.Printf("Host %s is answering again, closing its circuit", host)
+			broadcastEvent("host_recovered", gin.H{"host": host})
+			go onHostRecovered(host)
+		}
+		return
+	}
+	b := breakerFor(host)
+	b.failures++
+	b.lastError = failure
+	b.probeURL = rawURL
+	var opened bool
+	switch {
+	case b.state == circuitHalfOpen:
+		b.cooldown = min(2*b.cooldown, breakerMaxCooldown)
+		b.state = circuitOpen
+		b.retryAt = time.Now().Add(b.cooldown)
+	case b.state == circuitClosed && b.failures >= breakerThreshold:
+		b.cooldown = breakerCooldown
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		b.retryAt = b.openedAt.Add(b.cooldown)
+		opened = true
+	}
+	retryAt := b.retryAt
+	breakersMu.Unlock()
+	if opened {
+		log.Printf("Opening circuit for %s after %d failures (%s); retrying at %s", host, breakerThreshold, failure, retryAt.Format(time.TimeOnly))
+		broadcastEvent("host_unavailable", gin.H{"host": host, "error": failure, "retryAt": retryAt})
+	}
+}
+
+// responseFailure classifies a response for the breaker: server errors mean
+// the host is in trouble, anything else means it is up.
+func responseFailure(resp *http.Response) string {
+	if resp.StatusCode >= 500 {
+		return resp.Status
+	}
+	return ""
+}
+
+// hostCircuitOpen reports whether host is currently being skipped.
+func hostCircuitOpen(host string) bool {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	return ok && b.state != circuitClosed
+}
+
+// resetBreaker closes a host's circuit by hand.
+func resetBreaker(host string) {
+	breakersMu.Lock()
+	delete(breakers, host)
+	breakersMu.Unlock()
+}
+
+// attemptHost is the host an attempt depends on: the image host once the
+// link was resolved, the link's host before.
+func attemptHost(a PhotoAttempt) string {
+	if a.ImageURL != "" {
+		return hostOf(a.ImageURL)
+	}
+	return hostOf(a.LinkURL)
+}
+
+// deferredAttempts loads the deferred attempts for host, or for every host
+// when host is "".
+func deferredAttempts(host string) ([]PhotoAttempt, error) {
+	rows, err := db.Query(`SELECT `+attemptColumns+` FROM photo_attempts WHERE status = ? ORDER BY request_id, id`, attemptDeferred)
+	if err != nil {
+		return nil, fmt.Errorf("querying deferred attempts: %v", err)
+	}
+	defer rows.Close()
+	all, err := scanAttempts(rows)
+	if err != nil {
+		return nil, err
+	}
+	var attempts []PhotoAttempt
+	for _, a := range all {
+		if host == "" || attemptHost(a) == host {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+// retryDeferredAttempts re-queues the images deferred while host was down.
+func retryDeferredAttempts(host string) {
+	attempts, err := deferredAttempts(host)
+	if err != nil {
+		log.Printf("Error loading deferred attempts for %s: %v", host, err)
+		return
+	}
+	if len(attempts) == 0 {
+		return
+	}
+	log.Printf("Re-queuing %d deferred images for %s", len(attempts), host)
+	byRequest := make(map[int][]PhotoAttempt)
+	var order []int
+	for _, a := range attempts {
+		if _, ok := byRequest[a.RequestID]; !ok {
+			order = append(order, a.RequestID)
+		}
+		byRequest[a.RequestID] = append(byRequest[a.RequestID], a)
+	}
+	for _, requestID := range order {
+		if err := retryAttempts(requestID, byRequest[requestID]); err != nil {
+			log.Printf("Error retrying deferred images of request %d: %v", requestID, err)
+		}
+	}
+}
+
+// loadDeferredHosts opens the circuit of every host with deferred attempts
+// left from a previous run, so the prober checks them before re-queuing.
+func loadDeferredHosts() error {
+	attempts, err := deferredAttempts("")
+	if err != nil {
+		return err
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	for _, a := range attempts {
+		host := attemptHost(a)
+		if _, ok := breakers[host]; ok || host == "" {
+			continue
+		}
+		probeURL := a.ImageURL
+		if probeURL == "" {
+			probeURL = a.LinkURL
+		}
+		breakers[host] = &hostBreaker{state: circuitOpen, cooldown: breakerCooldown, openedAt: time.Now(),
+			retryAt: time.Now(), lastError: a.LastError, probeURL: probeURL}
+	}
+	return nil
+}
+
+// probeOpenCircuits runs forever, sending a HEAD request to each open host
+// whose cooldown has passed and that no other request has tried since. The
+// transport records the outcome, closing the circuit on success.
+func probeOpenCircuits(interval time.Duration) {
+	client := newHTTPClient(httpSettings.Timeout)
+	for range time.Tick(interval) {
+		breakersMu.Lock()
+		var due []string
+		for _, b := range breakers {
+			if b.state == circuitOpen && !time.Now().Before(b.retryAt) && b.probeURL != "" {
+				due = append(due, b.probeURL)
+			}
+		}
+		breakersMu.Unlock()
+		for _, probeURL := range due {
+			resp, err := client.Head(probeURL)
+			if err != nil {
+				log.Printf("Probe of %s failed: %v", hostOf(probeURL), err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+// BreakerStatus is a host's circuit as shown on the admin endpoint.
+type BreakerStatus struct {
+	Host      string `json:"host"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	OpenedAt  string `json:"openedAt,omitempty"`
+	RetryAt   string `json:"retryAt,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	Deferred  int    `json:"deferred"`
+}
+
+// listBreakers shows every host with failures or deferred images.
+func listBreakers(c *gin.Context) {
+	deferred := make(map[string]int)
+	attempts, err := deferredAttempts("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, a := range attempts {
+		deferred[attemptHost(a)]++
+	}
+
+	breakersMu.Lock()
+	statuses := make([]BreakerStatus, 0, len(breakers))
+	for host, b := range breakers {
+		if b.state == circuitClosed && b.failures == 0 && deferred[host] == 0 {
+			continue
+		}
+		s := BreakerStatus{Host: host, State: b.state, Failures: b.failures, LastError: b.lastError, Deferred: deferred[host]}
+		if !b.openedAt.IsZero() {
+			s.OpenedAt = b.openedAt.UTC().Format(time.RFC3339)
+			s.RetryAt = b.retryAt.UTC().Format(time.RFC3339)
+		}
+		statuses = append(statuses, s)
+		delete(deferred, host)
+	}
+	breakersMu.Unlock()
+	for host, n := range deferred {
+		statuses = append(statuses, BreakerStatus{Host: host, State: circuitClosed, Deferred: n})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	c.JSON(http.StatusOK, statuses)
+}
+
+// resetBreakerHandler closes a host's circuit and re-queues its deferred
+// images straight away.
+func resetBreakerHandler(c *gin.Context) {
+	host := strings.ToLower(c.Param("host"))
+	resetBreaker(host)
+	attempts, err := deferredAttempts(host)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go retryDeferredAttempts(host)
+	c.JSON(http.StatusOK, gin.H{"message": "Circuit closed", "queued": len(attempts)})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	// A recovered host re-queues its deferred attempts from the database,
+	// which is not part of this test.
+	recovered := onHostRecovered
+	onHostRecovered = func(string) {}
+	t.Cleanup(func() { onHostRecovered = recovered })
+	threshold, cooldown, maxCooldown := breakerThreshold, breakerCooldown, breakerMaxCooldown
+	breakerThreshold, breakerCooldown, breakerMaxCooldown = 3, time.Minute, 3*time.Minute
+	t.Cleanup(func() {
+		breakerThreshold, breakerCooldown, breakerMaxCooldown = threshold, cooldown, maxCooldown
+	})
+
+	// Steps: "fail" and "ok" record an outcome, "allow" and "deny" expect
+	// breakerAllow to let a request through or not, and "expire" ends the
+	// cooldown.
+	type step struct {
+		action   string
+		state    string        // state after the step
+		cooldown time.Duration // checked when not zero
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "failures below the threshold keep the circuit closed",
+			steps: []step{
+				{action: "fail", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+				{action: "allow", state: circuitClosed},
+			},
+		},
+		{
+			name: "a success resets the failure count",
+			steps: []step{
+				{action: "fail", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+				{action: "ok", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+				{action: "allow", state: circuitClosed},
+			},
+		},
+		{
+			name: "the threshold opens the circuit",
+			steps: []step{
+				{action: "fail", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+				{action: "fail", state: circuitOpen, cooldown: time.Minute},
+				{action: "deny", state: circuitOpen},
+			},
+		},
+		{
+			name: "one probe goes out after the cooldown",
+			steps: []step{
+				{action: "fail"}, {action: "fail"}, {action: "fail", state: circuitOpen},
+				{action: "expire", state: circuitOpen},
+				{action: "allow", state: circuitHalfOpen},
+				{action: "deny", state: circuitHalfOpen},
+			},
+		},
+		{
+			name: "a failed probe reopens with a doubled cooldown up to the maximum",
+			steps: []step{
+				{action: "fail"}, {action: "fail"}, {action: "fail", state: circuitOpen},
+				{action: "expire"}, {action: "allow"}, {action: "fail", state: circuitOpen, cooldown: 2 * time.Minute},
+				{action: "deny", state: circuitOpen},
+				{action: "expire"}, {action: "allow"}, {action: "fail", state: circuitOpen, cooldown: 3 * time.Minute},
+				{action: "expire"}, {action: "allow"}, {action: "fail", state: circuitOpen, cooldown: 3 * time.Minute},
+			},
+		},
+		{
+			name: "a successful probe closes the circuit",
+			steps: []step{
+				{action: "fail"}, {action: "fail"}, {action: "fail", state: circuitOpen},
+				{action: "expire"}, {action: "allow", state: circuitHalfOpen},
+				{action: "ok", state: circuitClosed},
+				{action: "allow", state: circuitClosed},
+				{action: "fail", state: circuitClosed},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := "breaker-test-" + string(rune('a'+i)) + ".invalid"
+			t.Cleanup(func() { resetBreaker(host) })
+			for n, s := range tt.steps {
+				switch s.action {
+				case "fail":
+					breakerRecord(host, "https://"+host+"/x.jpg", "502 Bad Gateway")
+				case "ok":
+					breakerRecord(host, "https://"+host+"/x.jpg", "")
+				case "allow":
+					if _, err := breakerAllow(host); err != nil {
+						t.Fatalf("step %d: breakerAllow = %v, want nil", n, err)
+					}
+				case "deny":
+					if _, err := breakerAllow(host); !errors.Is(err, ErrHostUnavailable) {
+						t.Fatalf("step %d: breakerAllow = %v, want ErrHostUnavailable", n, err)
+					}
+				case "expire":
+					breakersMu.Lock()
+					breakers[host].retryAt = time.Now().Add(-time.Second)
+					breakersMu.Unlock()
+				}
+
+				breakersMu.Lock()
+				state, cooldown := circuitClosed, time.Duration(0)
+				if b, ok := breakers[host]; ok {
+					state, cooldown = b.state, b.cooldown
+				}
+				breakersMu.Unlock()
+				if s.state != "" && state != s.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", n, s.action, state, s.state)
+				}
+				if s.cooldown != 0 && cooldown != s.cooldown {
+					t.Fatalf("step %d (%s): cooldown = %v, want %v", n, s.action, cooldown, s.cooldown)
+				}
+				if open := hostCircuitOpen(host); open != (state != circuitClosed) {
+					t.Fatalf("step %d (%s): hostCircuitOpen = %v in state %s", n, s.action, open, state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerProbeCancelledWhileWaiting(t *testing.T) {
+	recovered := onHostRecovered
+	onHostRecovered = func(string) {}
+	t.Cleanup(func() { onHostRecovered = recovered })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	host := "127.0.0.1"
+	transport := &limitedTransport{base: http.DefaultTransport}
+
+	// The circuit is open and its cooldown is over, so the next request is
+	// the probe; the host's only slot is taken, so the probe has to wait.
+	breakersMu.Lock()
+	breakers[host] = &hostBreaker{state: circuitOpen, failures: 5, cooldown: time.Minute, retryAt: time.Now().Add(-time.Second)}
+	breakersMu.Unlock()
+	t.Cleanup(func() { resetBreaker(host) })
+	hostLimitersMu.Lock()
+	l := newHostLimiter(1000, 1, true)
+	hostLimiters[host] = l
+	hostLimitersMu.Unlock()
+	t.Cleanup(func() {
+		hostLimitersMu.Lock()
+		delete(hostLimiters, host)
+		hostLimitersMu.Unlock()
+	})
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RoundTrip = %v, want %v", err, context.DeadlineExceeded)
+	}
+	breakersMu.Lock()
+	state, failures := breakers[host].state, breakers[host].failures
+	breakersMu.Unlock()
+	if state != circuitOpen || failures != 5 {
+		t.Errorf("after the cancelled probe: state %s with %d failures, want %s with 5", state, failures, circuitOpen)
+	}
+
+	// The next request probes at once and closes the circuit.
+	l.release()
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip after the cancelled probe: %v", err)
+	}
+	resp.Body.Close()
+	if hostCircuitOpen(host) {
+		t.Error("circuit still open after a successful probe")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envOr reads a string setting, falling back when it is unset.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt reads a positive integer setting, falling back on absent or bad values.
+func envInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// envFloat reads a positive number setting, falling back on absent or bad values.
+func envFloat(key string, fallback float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && f > 0 {
+		return f
+	}
+	return fallback
+}
+
+// envSeconds reads a duration given in whole seconds.
+func envSeconds(key string, fallback time.Duration) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return fallback
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/publicsuffix"
+)
+
+// SiteCookie is one cookie in the persistent store. Domain has no leading
+// dot; unless HostOnly is set the cookie is also sent to subdomains.
+type SiteCookie struct {
+	Domain   string `json:"domain"`
+	HostOnly bool   `json:"hostOnly"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	Expires  int64  `json:"expires,omitempty"` // unix seconds, 0 for a session cookie
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"httpOnly"`
+}
+
+func (c SiteCookie) key() string {
+	return c.Domain + "|" + c.Path + "|" + c.Name
+}
+
+func (c SiteCookie) matchesHost(host string) bool {
+	return host == c.Domain || (!c.HostOnly && strings.HasSuffix(host, "."+c.Domain))
+}
+
+// isPublicSuffix reports whether domain is a public suffix such as com or
+// co.uk, which no site may set a domain-wide cookie for.
+func isPublicSuffix(domain string) bool {
+	_, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	return err != nil
+}
+
+func (c SiteCookie) expired(now time.Time) bool {
+	return c.Expires != 0 && c.Expires <= now.Unix()
+}
+
+// siteCookieJar is an http.CookieJar backed by the site_cookies table. It is
+// shared by the forum client, file downloads and every colly collector, so a
+// session imported from the browser or set by a login response is used
+// everywhere and survives restarts. Session cookies are kept too: the forum
+// session is exactly the kind of cookie we want to keep.
+type siteCookieJar struct {
+	mu      sync.RWMutex
+	cookies map[string]SiteCookie
+}
+
+var siteCookies = &siteCookieJar{cookies: make(map[string]SiteCookie)}
+
+func normalizeCookieDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+}
+
+// loadSiteCookies reads the cookie store from the database.
+func loadSiteCookies() error {
+	rows, err := db.Query(`SELECT domain, host_only, name, value, path, expires, secure, http_only FROM site_cookies`)
+	if err != nil {
+		return fmt.Errorf("querying site cookies: %v", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]SiteCookie)
+	for rows.Next() {
+		var c SiteCookie
+		if err := rows.Scan(&c.Domain, &c.HostOnly, &c.Name, &c.Value, &c.Path, &c.Expires, &c.Secure, &c.HttpOnly); err != nil {
+			return fmt.Errorf("scanning site cookie: %v", err)
+		}
+		if !c.HostOnly && isPublicSuffix(c.Domain) {
+			continue
+		}
+		loaded[c.key()] = c
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	siteCookies.mu.Lock()
+	siteCookies.cookies = loaded
+	siteCookies.mu.Unlock()
+	log.Printf("Loaded %d site cookies", len(loaded))
+	return nil
+}
+
+// Cookies implements http.CookieJar.
+func (j *siteCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	j.mu.RLock()
+	var matched []SiteCookie
+	for _, c := range j.cookies {
+		if !c.matchesHost(host) || c.expired(now) || !strings.HasPrefix(path, c.Path) {
+			continue
+		}
+		if c.Secure && u.Scheme != "https" {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	j.mu.RUnlock()
+
+	// More specific paths first, as browsers send them.
+	sort.Slice(matched, func(a, b int) bool { return len(matched[a].Path) > len(matched[b].Path) })
+	cookies := make([]*http.Cookie, 0, len(matched))
+	for _, c := range matched {
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+// SetCookies implements http.CookieJar. Cookies for a domain the URL's host
+// does not belong to are ignored, as are domain cookies for a public suffix
+// unless the host is that suffix itself, which gets a host-only cookie.
+func (j *siteCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+	for _, hc := range cookies {
+		c := SiteCookie{
+			Domain:   normalizeCookieDomain(hc.Domain),
+			Name:     hc.Name,
+			Value:    hc.Value,
+			Path:     hc.Path,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+		}
+		if c.Domain == "" {
+			c.Domain, c.HostOnly = host, true
+		}
+		if !c.HostOnly && isPublicSuffix(c.Domain) {
+			if c.Domain != host {
+				continue
+			}
+			c.HostOnly = true
+		}
+		if !c.matchesHost(host) {
+			continue
+		}
+		if c.Path == "" || !strings.HasPrefix(c.Path, "/") {
+			c.Path = "/"
+		}
+		switch {
+		case hc.MaxAge < 0:
+			c.Expires = now.Unix()
+		case hc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(hc.MaxAge) * time.Second).Unix()
+		case !hc.Expires.IsZero():
+			c.Expires = hc.Expires.Unix()
+		}
+		if c.expired(now) {
+			j.remove(c)
+			continue
+		}
+		j.put(c)
+	}
+}
+
+// put stores a cookie, writing through to the database only when it changed.
+func (j *siteCookieJar) put(c SiteCookie) {
+	j.mu.Lock()
+	if existing, ok := j.cookies[c.key()]; ok && existing == c {
+		j.mu.Unlock()
+		return
+	}
+	j.cookies[c.key()] = c
+	j.mu.Unlock()
+
+	_, err := execWithRetry(`
+		INSERT INTO site_cookies (domain, name, path, value, host_only, expires, secure, http_only)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (domain, name, path) DO UPDATE SET
+			value = excluded.value,
+			host_only = excluded.host_only,
+			expires = excluded.expires,
+			secure = excluded.secure,
+			http_only = excluded.http_only,
+			updated_at = CURRENT_TIMESTAMP`,
+		c.Domain, c.Name, c.Path, c.Value, c.HostOnly, c.Expires, c.Secure, c.HttpOnly)
+	if err != nil {
+		log.Printf("Failed to save cookie %s for %s: %v", c.Name, c.Domain, err)
+	}
+}
+
+func (j *siteCookieJar) remove(c SiteCookie) {
+	j.mu.Lock()
+	_, ok := j.cookies[c.key()]
+	delete(j.cookies, c.key())
+	j.mu.Unlock()
+	if !ok {
+		return
+	}
+	if _, err := execWithRetry("DELETE FROM site_cookies WHERE domain = ? AND name = ? AND path = ?", c.Domain, c.Name, c.Path); err != nil {
+		log.Printf("Failed to delete cookie %s for %s: %v", c.Name, c.Domain, err)
+	}
+}
+
+// forHost lists the stored cookies that would be sent to host.
+func (j *siteCookieJar) forHost(host string) []SiteCookie {
+	host = normalizeCookieDomain(host)
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	cookies := []SiteCookie{}
+	for _, c := range j.cookies {
+		if c.matchesHost(host) {
+			cookies = append(cookies, c)
+		}
+	}
+	sort.Slice(cookies, func(a, b int) bool { return cookies[a].key() < cookies[b].key() })
+	return cookies
+}
+
+// removeMatching deletes the cookies sent to host whose name matches.
+func (j *siteCookieJar) removeMatching(host string, match func(name string) bool) {
+	for _, c := range j.forHost(host) {
+		if match(c.Name) {
+			j.remove(c)
+		}
+	}
+}
+
+// replaceDomain swaps every cookie stored for exactly domain for cookies.
+func (j *siteCookieJar) replaceDomain(domain string, cookies []SiteCookie) {
+	j.mu.RLock()
+	var old []SiteCookie
+	for _, c := range j.cookies {
+		if c.Domain == domain {
+			old = append(old, c)
+		}
+	}
+	j.mu.RUnlock()
+
+	keep := make(map[string]bool)
+	for _, c := range cookies {
+		keep[c.key()] = true
+	}
+	for _, c := range old {
+		if !keep[c.key()] {
+			j.remove(c)
+		}
+	}
+	for _, c := range cookies {
+		j.put(c)
+	}
+}
+
+// setDefaultCookie stores a cookie a ripper depends on. Any value already in
+// the store, e.g. one imported from a browser, is left alone.
+func setDefaultCookie(domain, path, name, value string) {
+	if path == "" {
+		path = "/"
+	}
+	c := SiteCookie{Domain: normalizeCookieDomain(domain), Name: name, Value: value, Path: path}
+	siteCookies.mu.RLock()
+	_, ok := siteCookies.cookies[c.key()]
+	siteCookies.mu.RUnlock()
+	if !ok {
+		siteCookies.put(c)
+	}
+}
+
+// parseNetscapeCookies reads a cookies.txt export (the format written by curl
+// and browser extensions): domain, include-subdomains flag, path, secure,
+// expiry, name and value separated by tabs. Lines prefixed with #HttpOnly_
+// are HttpOnly cookies rather than comments.
+func parseNetscapeCookies(r io.Reader) ([]SiteCookie, error) {
+	var cookies []SiteCookie
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab-separated fields, got %d", lineNo, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", lineNo, fields[4])
+		}
+		c := SiteCookie{
+			Domain:   normalizeCookieDomain(fields[0]),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Expires:  expires,
+			Name:     fields[5],
+			Value:    strings.Join(fields[6:], "\t"),
+			HttpOnly: httpOnly,
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		cookies = append(cookies, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading cookies file: %v", err)
+	}
+	return cookies, nil
+}
+
+func listSiteCookies(c *gin.Context) {
+	c.JSON(http.StatusOK, siteCookies.forHost(c.Param("host")))
+}
+
+// putSiteCookies replaces the cookies stored for a site with the JSON array
+// in the body. Entries without a domain belong to the site itself.
+func putSiteCookies(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	var cookies []SiteCookie
+	if err := c.ShouldBindJSON(&cookies); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	for i := range cookies {
+		cookies[i].Domain = normalizeCookieDomain(cookies[i].Domain)
+		if cookies[i].Domain == "" {
+			cookies[i].Domain = host
+		}
+		if cookies[i].Domain != host {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Cookie %s has domain %s, not %s", cookies[i].Name, cookies[i].Domain, host)})
+			return
+		}
+		if cookies[i].Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cookie name is required"})
+			return
+		}
+		if cookies[i].Path == "" {
+			cookies[i].Path = "/"
+		}
+	}
+	siteCookies.replaceDomain(host, cookies)
+	c.JSON(http.StatusOK, siteCookies.forHost(host))
+}
+
+func deleteSiteCookies(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	siteCookies.replaceDomain(host, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Cookies deleted"})
+}
+
+// importCookies merges a Netscape cookies.txt export into the store. The file
+// is taken from the "file" form field or, failing that, the raw body.
+func importCookies(c *gin.Context) {
+	var r io.Reader = c.Request.Body
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to open upload: " + err.Error()})
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+	cookies, err := parseNetscapeCookies(r)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	imported, skipped := 0, 0
+	domains := make(map[string]bool)
+	for _, ck := range cookies {
+		if ck.expired(now) || (!ck.HostOnly && isPublicSuffix(ck.Domain)) {
+			skipped++
+			continue
+		}
+		siteCookies.put(ck)
+		domains[ck.Domain] = true
+		imported++
+	}
+	log.Printf("Imported %d cookies for %d domains (%d expired or public-suffix skipped)", imported, len(domains), skipped)
+	c.JSON(http.StatusOK, gin.H{"imported": imported, "skipped": skipped, "domains": len(domains)})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNetscapeCookies(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []SiteCookie
+		wantErr bool
+	}{
+		{
+			name: "domain cookie",
+			input: "# Netscape HTTP Cookie File\n" +
+				".Example.com\tTRUE\t/\tTRUE\t1900000000\tbbuserid\t42\n",
+			want: []SiteCookie{{Domain: "example.com", Path: "/", Secure: true, Expires: 1900000000, Name: "bbuserid", Value: "42"}},
+		},
+		{
+			name:  "host-only session cookie with empty path",
+			input: "forum.example.com\tFALSE\t\tFALSE\t0\tsid\tabc\r\n",
+			want:  []SiteCookie{{Domain: "forum.example.com", HostOnly: true, Path: "/", Name: "sid", Value: "abc"}},
+		},
+		{
+			name:  "HttpOnly prefix is not a comment",
+			input: "#HttpOnly_.example.com\tTRUE\t/forum\tFALSE\t0\tsess\tv\n",
+			want:  []SiteCookie{{Domain: "example.com", Path: "/forum", Name: "sess", Value: "v", HttpOnly: true}},
+		},
+		{
+			name:  "tab in value",
+			input: "example.com\tFALSE\t/\tFALSE\t0\tpair\ta\tb\n",
+			want:  []SiteCookie{{Domain: "example.com", HostOnly: true, Path: "/", Name: "pair", Value: "a\tb"}},
+		},
+		{
+			name:  "comments and blank lines only",
+			input: "# comment\n\n   \n",
+		},
+		{
+			name:    "too few fields",
+			input:   "example.com\tFALSE\t/\tFALSE\t0\tname\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad expiry",
+			input:   "example.com\tFALSE\t/\tFALSE\tsoon\tname\tvalue\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNetscapeCookies(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCookiesRejectsPublicSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawURL string
+		domain string
+	}{
+		{name: "top-level domain", rawURL: "https://forum.example.com/", domain: "com"},
+		{name: "leading dot", rawURL: "https://forum.example.com/", domain: ".com"},
+		{name: "multi-label suffix", rawURL: "https://forum.example.co.uk/", domain: "co.uk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jar := &siteCookieJar{cookies: make(map[string]SiteCookie)}
+			u, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "secret", Domain: tt.domain}})
+			if len(jar.cookies) != 0 {
+				t.Errorf("stored %+v, want the cookie dropped", jar.cookies)
+			}
+			other, _ := url.Parse("https://attacker.example.net/")
+			if got := jar.Cookies(other); len(got) != 0 {
+				t.Errorf("Cookies(%s) = %v, want none", other, got)
+			}
+		})
+	}
+}
+
+func TestIsPublicSuffix(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"com", true},
+		{"co.uk", true},
+		{"example.com", false},
+		{"forum.example.co.uk", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicSuffix(tt.domain); got != tt.want {
+			t.Errorf("isPublicSuffix(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// credentialsKeyEnv names the environment variable holding the secret used to
+// encrypt stored passwords. Any string works; it is hashed to an AES-256 key.
+const credentialsKeyEnv = "CREDENTIALS_KEY"
+
+// loginRetryInterval stops a site with bad credentials from being hammered
+// with a login on every page fetch.
+const loginRetryInterval = 5 * time.Minute
+
+var errNoCredentialsKey = errors.New(credentialsKeyEnv + " is not set")
+
+// SiteCredential is a forum account used to refresh an expired session.
+type SiteCredential struct {
+	Host           string `json:"host"`
+	Username       string `json:"username"`
+	Password       string `json:"-"`
+	LoginURL       string `json:"loginUrl,omitempty"` // overrides the engine's default login page
+	LastLoginAt    string `json:"lastLoginAt,omitempty"`
+	LastLoginError string `json:"lastLoginError,omitempty"`
+	UpdatedAt      string `json:"updatedAt"`
+}
+
+func credentialsCipher() (cipher.AEAD, error) {
+	secret := os.Getenv(credentialsKeyEnv)
+	if secret == "" {
+		return nil, errNoCredentialsKey
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret seals plaintext with AES-GCM, returning base64(nonce|ciphertext).
+func encryptSecret(plaintext string) (string, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %v", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decoding secret: %v", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("stored secret is truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting secret (wrong %s?): %v", credentialsKeyEnv, err)
+	}
+	return string(plaintext), nil
+}
+
+// getCredential loads the account for host. The password is only decrypted
+// when withPassword is set, so listing works without the key.
+func getCredential(host string, withPassword bool) (SiteCredential, error) {
+	var cred SiteCredential
+	var encrypted string
+	var loginURL, lastLogin, lastError sql.NullString
+	err := db.QueryRow(`SELECT host, username, password, login_url, last_login_at, last_login_error, updated_at
+		FROM site_credentials WHERE host = ?`, host).Scan(
+		&cred.Host, &cred.Username, &encrypted, &loginURL, &lastLogin, &lastError, &cred.UpdatedAt)
+	if err != nil {
+		return cred, err
+	}
+	cred.LoginURL = loginURL.String
+	cred.LastLoginAt = lastLogin.String
+	cred.LastLoginError = lastError.String
+	if withPassword {
+		if cred.Password, err = decryptSecret(encrypted); err != nil {
+			return cred, err
+		}
+	}
+	return cred, nil
+}
+
+func recordLogin(host string, loginErr error) {
+	errText := ""
+	if loginErr != nil {
+		errText = loginErr.Error()
+	}
+	_, err := execWithRetry(`UPDATE site_credentials SET last_login_at = CURRENT_TIMESTAMP, last_login_error = ? WHERE host = ?`, errText, host)
+	if err != nil {
+		log.Printf("Failed to record login for %s: %v", host, err)
+	}
+}
+
+// forumAuthenticator is implemented by forum engines that can log in with a
+// stored account when a fetched page shows the session has expired.
+type forumAuthenticator interface {
+	// LoggedOut reports whether a fetched page was rendered for a guest.
+	LoggedOut(body []byte) bool
+	// Login signs in through forumClient, leaving the session in the cookie store.
+	Login(pageURL string, cred SiteCredential) error
+}
+
+var (
+	loginMu         sync.Mutex
+	loginLocks      = make(map[string]*sync.Mutex)
+	lastLoginTry    = make(map[string]time.Time)
+	lastLoginErr    = make(map[string]error)
+	errLoginSkipped = errors.New("login skipped")
+)
+
+// loginSiteKey folds www.example.com into example.com so both share a login.
+func loginSiteKey(host string) string {
+	return strings.TrimPrefix(host, "www.")
+}
+
+// refreshSession logs in to the site serving pageURL with its stored account.
+// Concurrent callers for the same host share one login, and a login is not
+// retried for loginRetryInterval: callers in that window get its outcome. It
+// returns errLoginSkipped when the site has no stored account.
+func refreshSession(auth forumAuthenticator, pageURL string) error {
+	host := hostOf(pageURL)
+	site := loginSiteKey(host)
+	loginMu.Lock()
+	lock, ok := loginLocks[site]
+	if !ok {
+		lock = &sync.Mutex{}
+		loginLocks[site] = lock
+	}
+	loginMu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	loginMu.Lock()
+	recent := time.Since(lastLoginTry[site]) < loginRetryInterval
+	lastErr := lastLoginErr[site]
+	loginMu.Unlock()
+	if recent {
+		return lastErr
+	}
+	err := loginWithCredential(auth, host, site, pageURL)
+	loginMu.Lock()
+	if err != errLoginSkipped {
+		lastLoginTry[site] = time.Now()
+		lastLoginErr[site] = err
+	}
+	loginMu.Unlock()
+	return err
+}
+
+// loginWithCredential logs in with the account stored for host, or for site
+// when host has none.
+func loginWithCredential(auth forumAuthenticator, host, site, pageURL string) error {
+	cred, err := getCredential(host, true)
+	if err == sql.ErrNoRows && site != host {
+		cred, err = getCredential(site, true)
+	}
+	if err == sql.ErrNoRows {
+		return errLoginSkipped
+	} else if err != nil {
+		return fmt.Errorf("loading credentials for %s: %v", host, err)
+	}
+	log.Printf("Session for %s has expired, logging in as %s", host, cred.Username)
+	err = auth.Login(pageURL, cred)
+	recordLogin(cred.Host, err)
+	if err != nil {
+		return fmt.Errorf("logging in to %s: %v", host, err)
+	}
+	log.Printf("Logged in to %s as %s", host, cred.Username)
+	return nil
+}
+
+func getSiteCredentials(c *gin.Context) {
+	cred, err := getCredential(normalizeCookieDomain(c.Param("host")), false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No credentials stored for this site"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, cred)
+}
+
+func putSiteCredentials(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		LoginURL string `json:"loginUrl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	encrypted, err := encryptSecret(req.Password)
+	if err == errNoCredentialsKey {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Set " + credentialsKeyEnv + " to store credentials"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = execWithRetry(`
+		INSERT INTO site_credentials (host, username, password, login_url) VALUES (?, ?, ?, ?)
+		ON CONFLICT (host) DO UPDATE SET
+			username = excluded.username,
+			password = excluded.password,
+			login_url = excluded.login_url,
+			last_login_error = NULL,
+			updated_at = CURRENT_TIMESTAMP`, host, req.Username, encrypted, req.LoginURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// New credentials deserve an immediate attempt.
+	loginMu.Lock()
+	delete(lastLoginTry, loginSiteKey(host))
+	loginMu.Unlock()
+
+	cred, _ := getCredential(host, false)
+	c.JSON(http.StatusOK, cred)
+}
+
+func deleteSiteCredentials(c *gin.Context) {
+	if _, err := execWithRetry("DELETE FROM site_credentials WHERE host = ?", normalizeCookieDomain(c.Param("host"))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credentials deleted"})
+}
+
+// loginSite forces a login, e.g. to check newly stored credentials.
+func loginSite(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	pageURL := "https://" + host + "/"
+	auth, ok := sourceFor(pageURL).(forumAuthenticator)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Automated login is not supported for this site"})
+		return
+	}
+	loginMu.Lock()
+	delete(lastLoginTry, loginSiteKey(host))
+	loginMu.Unlock()
+
+	err := refreshSession(auth, pageURL)
+	if err == errLoginSkipped {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No credentials stored for this site"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged in"})
+}
@@ -21,7 +21,12 @@ type Photo struct {
 var db *sql.DB
 
 func initDB() *sql.DB {
-	db, err := sql.Open("sqlite", "./gallery.db?_busy_timeout=5000")
+	return openDB("./gallery.db?_busy_timeout=5000")
+}
+
+// openDB opens the database at dsn and brings its schema up to date.
+func openDB(dsn string) *sql.DB {
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -101,38 +106,265 @@ func initDB() *sql.DB {
 		CREATE TABLE IF NOT EXISTS predictor_tests (
 			photo_path TEXT PRIMARY KEY,
 			tested_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS photo_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			request_id INTEGER NOT NULL,
+			link_url TEXT NOT NULL,
+			thumb_url TEXT,
+			ripper TEXT,
+			fallback BOOLEAN NOT NULL DEFAULT 0,
+			image_url TEXT NOT NULL DEFAULT '',
+			file_path TEXT,
+			post_dir TEXT,
+			status TEXT NOT NULL,
+			last_error TEXT,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (request_id, link_url, image_url),
+			FOREIGN KEY (request_id) REFERENCES requests(id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS thread_watches (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT UNIQUE NOT NULL,
+			last_post_id TEXT,
+			last_page INTEGER NOT NULL DEFAULT 1,
+			poll_interval_minutes INTEGER NOT NULL DEFAULT 60,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			last_checked_at DATETIME,
+			last_error TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			url TEXT,
+			status TEXT NOT NULL,
+			progress INTEGER NOT NULL DEFAULT 0,
+			total INTEGER NOT NULL DEFAULT 0,
+			found INTEGER NOT NULL DEFAULT 0,
+			queued INTEGER NOT NULL DEFAULT 0,
+			errors TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			finished_at DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS site_cookies (
+			domain TEXT NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL DEFAULT '/',
+			value TEXT NOT NULL,
+			host_only BOOLEAN NOT NULL DEFAULT 0,
+			expires INTEGER NOT NULL DEFAULT 0,
+			secure BOOLEAN NOT NULL DEFAULT 0,
+			http_only BOOLEAN NOT NULL DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (domain, name, path)
+		);
+		CREATE TABLE IF NOT EXISTS site_credentials (
+			host TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			password TEXT NOT NULL,
+			login_url TEXT,
+			last_login_at DATETIME,
+			last_login_error TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS site_blocks (
+			host TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			blocked_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS site_limits (
+			host TEXT PRIMARY KEY,
+			rps REAL NOT NULL,
+			max_in_flight INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS site_proxies (
+			host TEXT PRIMARY KEY,
+			proxy TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS placeholder_images (
+			sha256 TEXT PRIMARY KEY,
+			note TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);`)
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = db.Exec("UPDATE requests SET status = 'pending' WHERE status = 'processing'")
+	if err := addColumnIfMissing(db, "requests", "status", "TEXT DEFAULT 'pending'"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumnIfMissing(db, "photos", "media_type", "TEXT NOT NULL DEFAULT 'image'"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumnIfMissing(db, "photos", "sha256", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_photos_sha256 ON photos(sha256)"); err != nil {
+		log.Fatal(err)
+	}
+	for _, col := range []struct{ name, definition string }{
+		{"phash", "TEXT"},
+		{"width", "INTEGER"},
+		{"height", "INTEGER"},
+	} {
+		if err := addColumnIfMissing(db, "photos", col.name, col.definition); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := addColumnIfMissing(db, "photo_attempts", "fallback", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+	for _, col := range []struct{ name, definition string }{
+		{"thread_title", "TEXT"},
+		{"post_author", "TEXT"},
+		{"posted_at", "DATETIME"},
+		{"post_text", "TEXT"},
+	} {
+		if err := addColumnIfMissing(db, "galleries", col.name, col.definition); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_galleries_posted_at ON galleries(posted_at)"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumnIfMissing(db, "studios", "aliases", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumnIfMissing(db, "requests", "ingested", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+	// Interrupted requests go back to the queue, except ingested ones: their
+	// page was only ever in memory, so they are failed to be ingested again.
+	_, err = db.Exec("UPDATE requests SET status = CASE WHEN ingested THEN 'failed' ELSE 'pending' END WHERE status = 'processing'")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Background jobs do not survive a restart; the posts they queued do.
+	_, err = db.Exec("UPDATE jobs SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE status = ?", jobInterrupted, jobRunning)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return db
 }
 
-func storePhoto(requestURL, photoURL, filePath, thumbnailPath string) error {
+// addColumnIfMissing adds a column to an existing table so databases created
+// before the column existed keep working.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("reading columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return fmt.Errorf("scanning columns of %s: %v", table, err)
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	rows.Close()
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("adding column %s.%s: %v", table, column, err)
+	}
+	log.Printf("Added column %s.%s", table, column)
+	return nil
+}
+
+// requestIDForURL returns the id of the request for requestURL, inserting it
+// if needed.
+func requestIDForURL(requestURL string) (int, error) {
 	var requestID int
 	err := db.QueryRow("SELECT id FROM requests WHERE url = ?", requestURL).Scan(&requestID)
 	if err == sql.ErrNoRows {
 		result, err := db.Exec("INSERT INTO requests (url) VALUES (?)", requestURL)
 		if err != nil {
-			return fmt.Errorf("inserting request %s: %v", requestURL, err)
+			return 0, fmt.Errorf("inserting request %s: %v", requestURL, err)
 		}
 		id, err := result.LastInsertId()
 		if err != nil {
-			return fmt.Errorf("getting request ID: %v", err)
+			return 0, fmt.Errorf("getting request ID: %v", err)
 		}
-		requestID = int(id)
+		return int(id), nil
 	} else if err != nil {
-		return fmt.Errorf("querying request %s: %v", requestURL, err)
+		return 0, fmt.Errorf("querying request %s: %v", requestURL, err)
+	}
+	return requestID, nil
+}
+
+// queueRequest adds url to the download queue as pending. It reports false
+// when the url was already queued.
+func queueRequest(url string) (bool, error) {
+	res, err := execWithRetry(
+		"INSERT INTO requests (url, created_at, status) VALUES (?, ?, 'pending') ON CONFLICT(url) DO NOTHING",
+		url, time.Now().Format(time.RFC3339),
+	)
+	if err != nil {
+		return false, fmt.Errorf("queueing %s: %v", url, err)
 	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
 
+// claimRequest adds url as an ingested request already in processing, or
+// moves an existing request back to processing. Ingested requests are never
+// fetched by the queue workers, even after a restart. A request a worker is
+// already processing is left alone and claimed is false.
+func claimRequest(url string) (id int, claimed bool, err error) {
+	res, err := execWithRetry(
+		`INSERT INTO requests (url, created_at, status, ingested) VALUES (?, ?, 'processing', 1)
+		ON CONFLICT(url) DO UPDATE SET status = 'processing', ingested = 1 WHERE status IS NOT 'processing'`,
+		url, time.Now().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("claiming %s: %v", url, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, false, nil
+	}
+	id, err = requestIDForURL(url)
+	return id, err == nil, err
+}
+
+// requeueIngested hands a failed ingested request back to the queue, which
+// fetches the page itself from then on. It reports whether the request was
+// re-queued.
+func requeueIngested(requestID int) (bool, error) {
+	res, err := execWithRetry(
+		"UPDATE requests SET status = 'pending', ingested = 0 WHERE id = ? AND ingested AND status = 'failed'",
+		requestID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("re-queueing request %d: %v", requestID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func storePhoto(requestURL, photoURL string, photo *downloadedImage) error {
+	requestID, err := requestIDForURL(requestURL)
+	if err != nil {
+		return err
+	}
+
+	// Photos that could not be fingerprinted, such as videos, get NULLs.
+	var phash, width, height interface{}
+	if fp := photo.fingerprint; fp != nil {
+		phash, width, height = formatPHash(fp.hash), fp.width, fp.height
+	}
 	_, err = db.Exec(`
-		INSERT INTO photos (request_id, url, file_path, thumbnail_path) 
-		VALUES (?, ?, ?, ?)`,
-		requestID, photoURL, filePath, thumbnailPath)
+		INSERT INTO photos (request_id, url, file_path, thumbnail_path, media_type, sha256, phash, width, height) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		requestID, photoURL, photo.filePath, photo.thumbnailPath, photo.mediaType, photo.sha256, phash, width, height)
 	if err != nil {
 		return fmt.Errorf("inserting photo %s: %v", photoURL, err)
 	}
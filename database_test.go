@@ -0,0 +1,19 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// useTestDB points the package database at a fresh one with the full schema
+// for the duration of the test.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	testDB := openDB(filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=5000")
+	oldDB := db
+	db = testDB
+	t.Cleanup(func() {
+		db = oldDB
+		testDB.Close()
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dedupeFile replaces a new download whose content sum a stored photo already
+// has with a hard link to that copy, so the bytes are stored once.
+func dedupeFile(path, sum string) {
+	if original, ok := existingCopy(sum, path); ok {
+		if err := linkInPlace(original, path); err != nil {
+			log.Printf("Keeping duplicate %s of %s: %v", path, original, err)
+		} else {
+			log.Printf("Linked %s to identical %s", path, original)
+		}
+	}
+}
+
+// existingCopy finds a stored photo with content sum whose file still exists
+// and is not already the file at path, which may be missing.
+func existingCopy(sum, path string) (string, bool) {
+	rows, err := db.Query("SELECT DISTINCT file_path FROM photos WHERE sha256 = ? AND file_path != ? ORDER BY id", sum, path)
+	if err != nil {
+		log.Printf("Error looking up photos with hash %s: %v", sum, err)
+		return "", false
+	}
+	defer rows.Close()
+	pathInfo, _ := os.Stat(path)
+	for rows.Next() {
+		var candidate string
+		if err := rows.Scan(&candidate); err != nil {
+			continue
+		}
+		info, err := os.Stat(candidate)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+		if pathInfo != nil {
+			if os.SameFile(info, pathInfo) {
+				return "", false
+			}
+			if info.Size() != pathInfo.Size() {
+				continue
+			}
+		}
+		return candidate, true
+	}
+	return "", false
+}
+
+// linkInPlace replaces path with a hard link to original. Hard links need
+// both files on one file system; on failure path is left as it was.
+func linkInPlace(original, path string) error {
+	tmp := path + ".link"
+	os.Remove(tmp)
+	if err := os.Link(original, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// runHashBackfillJob hashes every photo stored before photos had hashes,
+// linking duplicates as it goes. It only looks at photos without a hash, so
+// an interrupted backfill simply continues when started again.
+func runHashBackfillJob(j *Job) {
+	type photo struct {
+		id   int
+		path string
+	}
+	rows, err := db.Query("SELECT id, file_path FROM photos WHERE sha256 IS NULL ORDER BY id")
+	if err != nil {
+		j.finish(fmt.Errorf("querying photos: %v", err))
+		return
+	}
+	var photos []photo
+	for rows.Next() {
+		var p photo
+		var path sql.NullString
+		if err := rows.Scan(&p.id, &path); err != nil {
+			rows.Close()
+			j.finish(fmt.Errorf("scanning photo: %v", err))
+			return
+		}
+		p.path = path.String
+		photos = append(photos, p)
+	}
+	rows.Close()
+
+	j.mu.Lock()
+	j.Total = len(photos)
+	j.mu.Unlock()
+	j.save()
+
+	for i, p := range photos {
+		if !fileDownloaded(p.path) {
+			j.addError(fmt.Errorf("photo %d: file %s is missing", p.id, p.path))
+		} else if sum, err := fileSHA256(p.path); err != nil {
+			j.addError(fmt.Errorf("photo %d: %v", p.id, err))
+		} else {
+			if _, err := execWithRetry("UPDATE photos SET sha256 = ? WHERE id = ?", sum, p.id); err != nil {
+				j.addError(fmt.Errorf("photo %d: %v", p.id, err))
+			}
+			if original, ok := existingCopy(sum, p.path); ok {
+				if err := linkInPlace(original, p.path); err != nil {
+					j.addError(fmt.Errorf("linking %s to %s: %v", p.path, original, err))
+				} else {
+					j.mu.Lock()
+					j.Found++
+					j.mu.Unlock()
+				}
+			}
+		}
+		j.mu.Lock()
+		j.Progress++
+		j.mu.Unlock()
+		if (i+1)%50 == 0 {
+			j.save()
+		}
+	}
+	j.mu.Lock()
+	log.Printf("Hash backfill job %d finished: %d photos hashed, %d duplicates linked", j.ID, j.Progress, j.Found)
+	j.mu.Unlock()
+	j.finish(nil)
+}
+
+func startHashBackfill(c *gin.Context) {
+	var running int
+	if err := db.QueryRow("SELECT COUNT(*) FROM jobs WHERE type = ? AND status = ?", jobHashBackfill, jobRunning).Scan(&running); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if running > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A hash backfill is already running"})
+		return
+	}
+	job, err := createJob(jobHashBackfill, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go runHashBackfillJob(job)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Hash backfill started", "jobId": job.ID})
+}
+
+// DuplicatePhoto is one copy in a group of identical photos.
+type DuplicatePhoto struct {
+	ID            int    `json:"id"`
+	RequestID     int    `json:"requestId"`
+	GalleryID     *int   `json:"galleryId,omitempty"`
+	GalleryName   string `json:"galleryName,omitempty"`
+	URL           string `json:"url"`
+	FilePath      string `json:"filePath"`
+	ThumbnailPath string `json:"thumbnailPath"`
+}
+
+type DuplicateGroup struct {
+	SHA256 string           `json:"sha256"`
+	Count  int              `json:"count"`
+	Photos []DuplicatePhoto `json:"photos"`
+}
+
+// listDuplicates returns groups of byte-identical photos, largest first.
+func listDuplicates(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "50"))
+	if perPage < 1 {
+		perPage = 50
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM (SELECT sha256 FROM photos WHERE sha256 IS NOT NULL
+		GROUP BY sha256 HAVING COUNT(*) > 1)`).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := db.Query(`SELECT sha256, COUNT(*) FROM photos WHERE sha256 IS NOT NULL
+		GROUP BY sha256 HAVING COUNT(*) > 1 ORDER BY COUNT(*) DESC, sha256 LIMIT ? OFFSET ?`, perPage, (page-1)*perPage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	groups := []DuplicateGroup{}
+	for rows.Next() {
+		var g DuplicateGroup
+		if err := rows.Scan(&g.SHA256, &g.Count); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+
+	for i := range groups {
+		photos, err := duplicatePhotos(groups[i].SHA256)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		groups[i].Photos = photos
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"groups":      groups,
+		"page":        page,
+		"per_page":    perPage,
+		"total":       total,
+		"total_pages": (total + perPage - 1) / perPage,
+	})
+}
+
+func duplicatePhotos(sum string) ([]DuplicatePhoto, error) {
+	rows, err := db.Query(`SELECT p.id, p.request_id, g.id, g.name, p.url, p.file_path, p.thumbnail_path
+		FROM photos p LEFT JOIN galleries g ON g.request_id = p.request_id
+		WHERE p.sha256 = ? ORDER BY p.id`, sum)
+	if err != nil {
+		return nil, fmt.Errorf("querying photos with hash %s: %v", sum, err)
+	}
+	defer rows.Close()
+	var photos []DuplicatePhoto
+	for rows.Next() {
+		var p DuplicatePhoto
+		var galleryID sql.NullInt64
+		var galleryName, url, thumbnail sql.NullString
+		if err := rows.Scan(&p.ID, &p.RequestID, &galleryID, &galleryName, &url, &p.FilePath, &thumbnail); err != nil {
+			return nil, fmt.Errorf("scanning photo: %v", err)
+		}
+		if galleryID.Valid {
+			id := int(galleryID.Int64)
+			p.GalleryID = &id
+		}
+		p.GalleryName = galleryName.String
+		p.URL = url.String
+		p.ThumbnailPath = thumbnail.String
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
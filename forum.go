@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// forumClient is the client used for every forum page fetch: post pages,
+// thread enumeration and watches.
+var forumClient = func() *http.Client {
+	c := newHTTPClient(httpSettings.Timeout)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		fmt.Printf("Redirecting to %s\n", req.URL.String())
+		return nil
+	}
+	return c
+}()
+
+// fetchForumPage fetches a forum page with the stored session cookies. A page
+// rendered for a guest means the session expired; if the site has stored
+// credentials we log in and fetch it again, and fail if the login did not take.
+// Sites without stored credentials are read as a guest.
+func fetchForumPage(targetUrl string) ([]byte, error) {
+	body, err := fetchForumPageOnce(targetUrl)
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := sourceFor(targetUrl).(forumAuthenticator)
+	if !ok || !auth.LoggedOut(body) {
+		return body, nil
+	}
+	if err := refreshSession(auth, targetUrl); err == errLoginSkipped {
+		return body, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("refreshing session for %s: %v", targetUrl, err)
+	}
+	body, err = fetchForumPageOnce(targetUrl)
+	if err != nil {
+		return nil, err
+	}
+	if auth.LoggedOut(body) {
+		return nil, fmt.Errorf("%s is still rendered for a guest after logging in", targetUrl)
+	}
+	return body, nil
+}
+
+// fetchForumPageOnce fetches a forum page, retrying transport errors. Non-200
+// responses and challenge pages are saved to response.html and returned as
+// errors; a challenge also blocks the site until it is resumed.
+func fetchForumPageOnce(targetUrl string) ([]byte, error) {
+	host := hostOf(targetUrl)
+	if siteBlocked(host) {
+		return nil, fmt.Errorf("%w: %s", ErrSiteBlocked, host)
+	}
+	req, err := http.NewRequest("GET", targetUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request for %s: %v", targetUrl, err)
+	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+
+	maxRetries := 3
+	var resp *http.Response
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		fmt.Printf("Attempt %d of %d to fetch %s\n", attempt, maxRetries, targetUrl)
+		resp, err = forumClient.Do(req)
+		if err != nil {
+			fmt.Printf("Request failed: %v\n", err)
+			// A blocked site or an open circuit will not clear in seconds.
+			if errors.Is(err, ErrSiteBlocked) || errors.Is(err, ErrHostUnavailable) {
+				return nil, fmt.Errorf("fetching %s: %w", targetUrl, err)
+			}
+			if attempt == maxRetries {
+				return nil, fmt.Errorf("fetching %s after %d attempts: %w", targetUrl, maxRetries, err)
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		break
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("no response received for %s after %d attempts", targetUrl, maxRetries)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("HTTP response for %s: Status %d\n", targetUrl, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+
+	// Challenge pages usually come with a 403 or 503, so check before the
+	// status code.
+	if reason := detectChallenge(body); reason != "" {
+		fmt.Printf("%s detected for %s. Please import fresh cookies from your browser.\n", reason, host)
+		saveResponseBody(body)
+		blockSite(host, reason)
+		return nil, fmt.Errorf("%w: %s (%s)", ErrSiteBlocked, host, reason)
+	}
+	if resp.StatusCode != 200 {
+		fmt.Printf("Non-200 status for %s: %d\n", targetUrl, resp.StatusCode)
+		saveResponseBody(body)
+		return nil, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, targetUrl)
+	}
+	return body, nil
+}
+
+// saveResponseBody keeps the last failed response for inspection.
+func saveResponseBody(body []byte) {
+	if err := os.WriteFile("response.html", body, 0644); err != nil {
+		fmt.Printf("Error saving response body: %v\n", err)
+	} else {
+		fmt.Println("Saved response body to response.html")
+	}
+}
+
+// fetchForumDocument fetches a forum page and parses it as HTML.
+func fetchForumDocument(pageURL string) (*goquery.Document, error) {
+	body, err := fetchForumPage(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing HTML from %s: %v", pageURL, err)
+	}
+	return doc, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// genericRipperName is recorded on attempts resolved by the fallback ripper.
+const genericRipperName = "generic"
+
+// genericRipper is the last-resort ripper for hosts without a purpose-built
+// one. It accepts any link, returns it as-is when it already serves an image,
+// and otherwise picks the page's og:image or its largest <img>.
+//
+// A link is only fetched to tell whether it is an image when its extension
+// does not say so, and then only up to the response headers.
+type genericRipper struct{}
+
+func init() {
+	builtinRippers[genericRipperName] = genericRipper{}
+	RegisterRipper(genericRipper{}, 1000)
+}
+
+func isFallbackRipper(r Ripper) bool {
+	_, ok := r.(genericRipper)
+	return ok
+}
+
+func (genericRipper) Name() string { return genericRipperName }
+
+func (genericRipper) Match(link PostLink) bool {
+	return strings.HasPrefix(link.Href, "http://") || strings.HasPrefix(link.Href, "https://")
+}
+
+// directImageExts are extensions returned without fetching the link.
+var directImageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true,
+}
+
+func hasImageExt(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return directImageExts[strings.ToLower(path.Ext(u.Path))]
+}
+
+type imgCandidate struct {
+	src  string
+	area int
+}
+
+func (genericRipper) Rip(link PostLink) ([]string, error) {
+	if hasImageExt(link.Href) {
+		return []string{link.Href}, nil
+	}
+	fmt.Printf("Starting generic rip for %s\n", link.Href)
+	c := newCollector()
+
+	var direct, metaImage string
+	var candidates []imgCandidate
+	c.OnResponseHeaders(func(r *colly.Response) {
+		if strings.HasPrefix(r.Headers.Get("Content-Type"), "image/") {
+			direct = r.Request.URL.String()
+			r.Request.Abort() // downloadImage fetches the body itself
+		}
+	})
+	c.OnHTML("meta[property='og:image'], meta[name='twitter:image'], link[rel='image_src']", func(e *colly.HTMLElement) {
+		if metaImage != "" {
+			return
+		}
+		v := e.Attr("content")
+		if v == "" {
+			v = e.Attr("href")
+		}
+		if v != "" {
+			metaImage = e.Request.AbsoluteURL(v)
+		}
+	})
+	c.OnHTML("img", func(e *colly.HTMLElement) {
+		src := e.Attr("src")
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return
+		}
+		w, _ := strconv.Atoi(strings.TrimSuffix(e.Attr("width"), "px"))
+		h, _ := strconv.Atoi(strings.TrimSuffix(e.Attr("height"), "px"))
+		if (w > 0 && w < 100) || (h > 0 && h < 100) {
+			return // icons, spacers, avatars
+		}
+		candidates = append(candidates, imgCandidate{src: e.Request.AbsoluteURL(src), area: w * h})
+	})
+
+	if err := c.Visit(link.Href); err != nil && !(direct != "" && errors.Is(err, colly.ErrAbortedAfterHeaders)) {
+		return nil, fmt.Errorf("visiting %s: %v", link.Href, err)
+	}
+	switch {
+	case direct != "":
+		return []string{direct}, nil
+	case metaImage != "":
+		return []string{metaImage}, nil
+	}
+	best := -1
+	for i, cand := range candidates {
+		if strings.Contains(strings.ToLower(cand.src), "logo") {
+			continue
+		}
+		if best == -1 || cand.area > candidates[best].area {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil, fmt.Errorf("no image candidates found on %s", link.Href)
+	}
+	fmt.Printf("Generic rip picked %s from %s\n", candidates[best].src, link.Href)
+	return []string{candidates[best].src}, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocolly/colly/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// HostRule declares how to resolve links for one image host without code.
+// A rule either rewrites a URL (usually the thumbnail) into the full-size
+// image URL, or visits the link and reads an attribute via a CSS selector.
+type HostRule struct {
+	Name     string        `json:"name" yaml:"name"`
+	Match    []string      `json:"match" yaml:"match"`                           // substrings of the link href
+	Priority int           `json:"priority,omitempty" yaml:"priority,omitempty"` // lower runs first
+	Disabled bool          `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Source   string        `json:"source,omitempty" yaml:"source,omitempty"` // "href" (default) or "thumb"
+	Rewrite  []RewriteRule `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Selector string        `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Attr     string        `json:"attr,omitempty" yaml:"attr,omitempty"` // defaults to "src"
+	Cookies  []RuleCookie  `json:"cookies,omitempty" yaml:"cookies,omitempty"`
+}
+
+// RewriteRule replaces From with To. When Regex is set, From is a regular
+// expression and To may reference its groups ($1).
+type RewriteRule struct {
+	From  string `json:"from" yaml:"from"`
+	To    string `json:"to" yaml:"to"`
+	Regex bool   `json:"regex,omitempty" yaml:"regex,omitempty"`
+}
+
+type RuleCookie struct {
+	Name   string `json:"name" yaml:"name"`
+	Value  string `json:"value" yaml:"value"`
+	Domain string `json:"domain" yaml:"domain"`
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+type hostRulesFile struct {
+	Hosts []HostRule `json:"hosts" yaml:"hosts"`
+}
+
+var (
+	hostRulesPath = envOr("HOST_RULES_FILE", "./host_rules.json")
+
+	hostRulesMu      sync.Mutex
+	hostRulesModTime time.Time
+	ruleRipperNames  []string
+	// ruleDisabled holds each rule's "disabled" value as last loaded, so a
+	// reload only overrides PUT /hosts/:name when the file itself changed it.
+	ruleDisabled = make(map[string]bool)
+)
+
+type ruleRipper struct {
+	rule     HostRule
+	rewrites []func(string) string
+}
+
+func newRuleRipper(rule HostRule) (*ruleRipper, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("host rule without a name")
+	}
+	if len(rule.Match) == 0 {
+		return nil, fmt.Errorf("host rule %s has no match patterns", rule.Name)
+	}
+	if len(rule.Rewrite) == 0 && rule.Selector == "" {
+		return nil, fmt.Errorf("host rule %s needs a rewrite or a selector", rule.Name)
+	}
+	r := &ruleRipper{rule: rule}
+	for _, rw := range rule.Rewrite {
+		rw := rw
+		if !rw.Regex {
+			r.rewrites = append(r.rewrites, func(s string) string { return strings.ReplaceAll(s, rw.From, rw.To) })
+			continue
+		}
+		re, err := regexp.Compile(rw.From)
+		if err != nil {
+			return nil, fmt.Errorf("host rule %s: bad rewrite pattern %q: %v", rule.Name, rw.From, err)
+		}
+		r.rewrites = append(r.rewrites, func(s string) string { return re.ReplaceAllString(s, rw.To) })
+	}
+	return r, nil
+}
+
+func (r *ruleRipper) Name() string { return r.rule.Name }
+
+func (r *ruleRipper) Match(link PostLink) bool {
+	for _, p := range r.rule.Match {
+		if strings.Contains(link.Href, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ruleRipper) Rip(link PostLink) ([]string, error) {
+	src := link.Href
+	if r.rule.Source == "thumb" {
+		src = link.Thumb
+	}
+	if src == "" {
+		return nil, fmt.Errorf("%s: empty %s for link", r.rule.Name, r.rule.Source)
+	}
+	if r.rule.Selector != "" {
+		imageURL, err := r.visit(src)
+		if err != nil {
+			return nil, err
+		}
+		src = imageURL
+	}
+	for _, rw := range r.rewrites {
+		src = rw(src)
+	}
+	fmt.Printf("Rule %s resolved %s to %s\n", r.rule.Name, link.Href, src)
+	return []string{src}, nil
+}
+
+func (r *ruleRipper) visit(pageURL string) (string, error) {
+	for _, ck := range r.rule.Cookies {
+		setDefaultCookie(ck.Domain, ck.Path, ck.Name, ck.Value)
+	}
+	c := newCollector()
+	attr := r.rule.Attr
+	if attr == "" {
+		attr = "src"
+	}
+	var imageURL string
+	c.OnHTML(r.rule.Selector, func(e *colly.HTMLElement) {
+		if imageURL == "" {
+			imageURL = e.Request.AbsoluteURL(e.Attr(attr))
+		}
+	})
+	if err := c.Visit(pageURL); err != nil {
+		return "", fmt.Errorf("visiting %s %s: %v", r.rule.Name, pageURL, err)
+	}
+	if imageURL == "" {
+		return "", fmt.Errorf("%s: selector %q matched nothing on %s", r.rule.Name, r.rule.Selector, pageURL)
+	}
+	return imageURL, nil
+}
+
+// loadHostRules reads the rules file, YAML when it ends in .yaml or .yml and
+// JSON otherwise, and swaps the rule-based rippers into the
+// registry. Built-in rippers shadowed by a rule are restored when the rule is
+// removed. On error the previously loaded rules stay active.
+func loadHostRules() error {
+	hostRulesMu.Lock()
+	defer hostRulesMu.Unlock()
+
+	info, err := os.Stat(hostRulesPath)
+	if err != nil {
+		return fmt.Errorf("reading host rules %s: %v", hostRulesPath, err)
+	}
+	data, err := os.ReadFile(hostRulesPath)
+	if err != nil {
+		return fmt.Errorf("reading host rules %s: %v", hostRulesPath, err)
+	}
+	var file hostRulesFile
+	switch strings.ToLower(filepath.Ext(hostRulesPath)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing host rules %s: %v", hostRulesPath, err)
+	}
+	rippers := make([]*ruleRipper, 0, len(file.Hosts))
+	for _, rule := range file.Hosts {
+		rr, err := newRuleRipper(rule)
+		if err != nil {
+			return err
+		}
+		rippers = append(rippers, rr)
+	}
+
+	wasEnabled := make(map[string]bool)
+	for _, name := range ruleRipperNames {
+		if info, ok := hostInfo(name); ok {
+			wasEnabled[name] = info.Enabled
+		}
+		unregisterRipper(name)
+		if b, ok := builtinRippers[name]; ok {
+			RegisterRipper(b, 0)
+		}
+	}
+	ruleRipperNames = ruleRipperNames[:0]
+	loaded := make(map[string]bool, len(rippers))
+	for _, rr := range rippers {
+		name := rr.rule.Name
+		RegisterRipper(rr, rr.rule.Priority)
+		enabled := !rr.rule.Disabled
+		if disabled, seen := ruleDisabled[name]; seen && disabled == rr.rule.Disabled {
+			if was, ok := wasEnabled[name]; ok {
+				enabled = was
+			}
+		}
+		setHostState(name, &enabled, nil)
+		ruleRipperNames = append(ruleRipperNames, name)
+		loaded[name] = rr.rule.Disabled
+	}
+	ruleDisabled = loaded
+	hostRulesModTime = info.ModTime()
+	log.Printf("Loaded %d host rules from %s", len(rippers), hostRulesPath)
+	return nil
+}
+
+// watchHostRules polls the rules file and reloads it when it changes.
+func watchHostRules(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		info, err := os.Stat(hostRulesPath)
+		if err != nil {
+			continue
+		}
+		hostRulesMu.Lock()
+		changed := !info.ModTime().Equal(hostRulesModTime)
+		hostRulesMu.Unlock()
+		if changed {
+			if err := loadHostRules(); err != nil {
+				log.Printf("Host rules reload failed: %v", err)
+			}
+		}
+	}
+}
+
+func reloadHostRules(c *gin.Context) {
+	if err := loadHostRules(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, listHostInfo())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PostLink is an image link found inside a forum post: the anchor target
+// and the thumbnail the poster embedded for it.
+type PostLink struct {
+	Href  string
+	Thumb string
+}
+
+// Ripper resolves post links for a single image host into direct image URLs.
+type Ripper interface {
+	// Name is the host name shown in logs and on /hosts.
+	Name() string
+	// Match reports whether this ripper handles the link.
+	Match(link PostLink) bool
+	// Rip returns the direct image URLs behind the link.
+	Rip(link PostLink) ([]string, error)
+}
+
+type hostEntry struct {
+	ripper   Ripper
+	enabled  bool
+	priority int
+	order    int
+}
+
+// HostInfo describes a registered ripper for the /hosts endpoint.
+type HostInfo struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Priority int    `json:"priority"`
+}
+
+var (
+	hostsMu  sync.RWMutex
+	hosts    []*hostEntry
+	hostsSeq int
+)
+
+// RegisterRipper adds a ripper to the registry. Rippers are tried in
+// ascending priority, then in registration order.
+func RegisterRipper(r Ripper, priority int) {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	for _, e := range hosts {
+		if e.ripper.Name() == r.Name() {
+			e.ripper = r
+			e.priority = priority
+			sortHosts()
+			return
+		}
+	}
+	hostsSeq++
+	hosts = append(hosts, &hostEntry{ripper: r, enabled: true, priority: priority, order: hostsSeq})
+	sortHosts()
+}
+
+func unregisterRipper(name string) {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	for i, e := range hosts {
+		if e.ripper.Name() == name {
+			hosts = append(hosts[:i], hosts[i+1:]...)
+			return
+		}
+	}
+}
+
+// sortHosts must be called with hostsMu held.
+func sortHosts() {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		if hosts[i].priority != hosts[j].priority {
+			return hosts[i].priority < hosts[j].priority
+		}
+		return hosts[i].order < hosts[j].order
+	})
+}
+
+// findRipper returns the first enabled ripper matching the link, or nil.
+func findRipper(link PostLink) Ripper {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	for _, e := range hosts {
+		if e.enabled && e.ripper.Match(link) {
+			return e.ripper
+		}
+	}
+	return nil
+}
+
+func setHostState(name string, enabled *bool, priority *int) (HostInfo, error) {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	for _, e := range hosts {
+		if !strings.EqualFold(e.ripper.Name(), name) {
+			continue
+		}
+		if enabled != nil {
+			e.enabled = *enabled
+		}
+		if priority != nil {
+			e.priority = *priority
+			sortHosts()
+		}
+		return HostInfo{Name: e.ripper.Name(), Enabled: e.enabled, Priority: e.priority}, nil
+	}
+	return HostInfo{}, fmt.Errorf("unknown host %s", name)
+}
+
+// hostInfo returns the current state of the named ripper.
+func hostInfo(name string) (HostInfo, bool) {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	for _, e := range hosts {
+		if strings.EqualFold(e.ripper.Name(), name) {
+			return HostInfo{Name: e.ripper.Name(), Enabled: e.enabled, Priority: e.priority}, true
+		}
+	}
+	return HostInfo{}, false
+}
+
+func listHostInfo() []HostInfo {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	out := make([]HostInfo, 0, len(hosts))
+	for _, e := range hosts {
+		out = append(out, HostInfo{Name: e.ripper.Name(), Enabled: e.enabled, Priority: e.priority})
+	}
+	return out
+}
+
+// funcRipper adapts the single-URL RipXxx functions to the Ripper interface.
+type funcRipper struct {
+	name     string
+	patterns []string
+	// useThumb passes the thumbnail src instead of the link target; used by
+	// hosts whose full-size URL is a rewrite of the thumbnail.
+	useThumb bool
+	rip      func(src string) (string, error)
+}
+
+func (f *funcRipper) Name() string { return f.name }
+
+func (f *funcRipper) Match(link PostLink) bool {
+	for _, p := range f.patterns {
+		if strings.Contains(link.Href, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *funcRipper) Rip(link PostLink) ([]string, error) {
+	src := link.Href
+	if f.useThumb {
+		src = link.Thumb
+	}
+	imageURL, err := f.rip(src)
+	if err != nil {
+		return nil, err
+	}
+	if imageURL == "" {
+		return nil, fmt.Errorf("%s returned no image for %s", f.name, link.Href)
+	}
+	return []string{imageURL}, nil
+}
+
+func listHosts(c *gin.Context) {
+	c.JSON(http.StatusOK, listHostInfo())
+}
+
+func updateHost(c *gin.Context) {
+	var req struct {
+		Enabled  *bool `json:"enabled"`
+		Priority *int  `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	info, err := setHostState(c.Param("name"), req.Enabled, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocolly/colly/v2"
+)
+
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:91.0) Gecko/20100101 Firefox/91.0"
+
+// httpSettings configures the shared transport, from the environment:
+//
+//	HTTP_USER_AGENT                  User-Agent for every request
+//	HTTP_TIMEOUT_SECONDS             whole-request timeout for page fetches (60)
+//	HTTP_DIAL_TIMEOUT_SECONDS        connect and TLS handshake timeout (15)
+//	HTTP_RESPONSE_TIMEOUT_SECONDS    wait for response headers (60)
+//	HTTP_MAX_IDLE_CONNS_PER_HOST     pooled keep-alive connections per host (8)
+//	HTTP_PROXY_URL                   proxy for hosts without their own; http://, https://, socks5://
+//
+// Without HTTP_PROXY_URL the standard HTTP_PROXY/HTTPS_PROXY variables apply.
+var httpSettings = struct {
+	UserAgent           string
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	ResponseTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	Proxy               string
+}{
+	UserAgent:           envOr("HTTP_USER_AGENT", defaultUserAgent),
+	Timeout:             envSeconds("HTTP_TIMEOUT_SECONDS", 60*time.Second),
+	DialTimeout:         envSeconds("HTTP_DIAL_TIMEOUT_SECONDS", 15*time.Second),
+	ResponseTimeout:     envSeconds("HTTP_RESPONSE_TIMEOUT_SECONDS", 60*time.Second),
+	MaxIdleConnsPerHost: envInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 8),
+	Proxy:               envOr("HTTP_PROXY_URL", ""),
+}
+
+// sharedTransport carries every outgoing request: forum pages, ripper pages
+// (colly), image downloads and StashDB. It pools connections, picks the proxy
+// per host, sets the User-Agent and applies the per-host circuit breakers and
+// rate limits.
+var sharedTransport http.RoundTripper = &limitedTransport{base: &http.Transport{
+	Proxy: proxyForRequest,
+	DialContext: (&net.Dialer{
+		Timeout:   httpSettings.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSClientConfig: &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+	},
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   httpSettings.MaxIdleConnsPerHost,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   httpSettings.DialTimeout,
+	ResponseHeaderTimeout: httpSettings.ResponseTimeout,
+	ExpectContinueTimeout: time.Second,
+}}
+
+// newHTTPClient returns a client on the shared transport and cookie store. A
+// zero timeout suits downloads of large files, which are still protected by
+// the dial and response header timeouts.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Jar:       siteCookies,
+		Transport: sharedTransport,
+	}
+}
+
+// newCollector returns a colly collector on the shared transport and cookie
+// store.
+func newCollector() *colly.Collector {
+	fmt.Println("Creating new Colly collector")
+	c := colly.NewCollector()
+	c.UserAgent = httpSettings.UserAgent
+	c.WithTransport(sharedTransport)
+	c.SetCookieJar(siteCookies)
+	c.SetRequestTimeout(httpSettings.Timeout)
+	return c
+}
+
+var (
+	siteProxiesMu sync.RWMutex
+	siteProxies   = make(map[string]*url.URL)
+)
+
+func loadSiteProxies() error {
+	rows, err := db.Query("SELECT host, proxy FROM site_proxies")
+	if err != nil {
+		return fmt.Errorf("querying site proxies: %v", err)
+	}
+	defer rows.Close()
+	siteProxiesMu.Lock()
+	defer siteProxiesMu.Unlock()
+	for rows.Next() {
+		var host, proxy string
+		if err := rows.Scan(&host, &proxy); err != nil {
+			return fmt.Errorf("scanning site proxy: %v", err)
+		}
+		u, err := parseProxyURL(proxy)
+		if err != nil {
+			log.Printf("Ignoring proxy for %s: %v", host, err)
+			continue
+		}
+		siteProxies[host] = u
+	}
+	return rows.Err()
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", raw)
+	}
+	return u, nil
+}
+
+// hostAndParents returns host followed by each parent domain, so settings
+// stored for example.com also cover img1.example.com.
+func hostAndParents(host string) []string {
+	keys := []string{host}
+	for {
+		i := strings.Index(host, ".")
+		if i < 0 || !strings.Contains(host[i+1:], ".") {
+			return keys
+		}
+		host = host[i+1:]
+		keys = append(keys, host)
+	}
+}
+
+// proxyForRequest picks the proxy stored for the request's host or a parent
+// domain, then HTTP_PROXY_URL, then the standard proxy environment.
+func proxyForRequest(req *http.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	siteProxiesMu.RLock()
+	for _, key := range hostAndParents(host) {
+		if u, ok := siteProxies[key]; ok {
+			siteProxiesMu.RUnlock()
+			return u, nil
+		}
+	}
+	siteProxiesMu.RUnlock()
+	if httpSettings.Proxy != "" {
+		return parseProxyURL(httpSettings.Proxy)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+func getSiteProxy(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	siteProxiesMu.RLock()
+	u, ok := siteProxies[host]
+	siteProxiesMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No proxy set for this site"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"host": host, "proxy": u.Redacted()})
+}
+
+func putSiteProxy(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	var req struct {
+		Proxy string `json:"proxy" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	u, err := parseProxyURL(req.Proxy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := execWithRetry("INSERT OR REPLACE INTO site_proxies (host, proxy) VALUES (?, ?)", host, u.String()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	siteProxiesMu.Lock()
+	siteProxies[host] = u
+	siteProxiesMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"host": host, "proxy": u.Redacted()})
+}
+
+func deleteSiteProxy(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	if _, err := execWithRetry("DELETE FROM site_proxies WHERE host = ?", host); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	siteProxiesMu.Lock()
+	delete(siteProxies, host)
+	siteProxiesMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Proxy removed"})
+}
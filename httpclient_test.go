@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostAndParents(t *testing.T) {
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"www.example.com", []string{"www.example.com", "example.com"}},
+		{"img1.cdn.example.com", []string{"img1.cdn.example.com", "cdn.example.com", "example.com"}},
+		{"localhost", []string{"localhost"}},
+		{"", []string{""}},
+	}
+	for _, tt := range tests {
+		if got := hostAndParents(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hostAndParents(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gin-gonic/gin"
+)
+
+// ingestHTML processes a forum page captured in the browser, for pages the
+// server cannot fetch itself. A URL with a post anchor ingests that post;
+// otherwise every post on the page becomes a request. Images are downloaded
+// in the background exactly as for a fetched page.
+func ingestHTML(c *gin.Context) {
+	var req struct {
+		URL  string `json:"url" form:"url" binding:"required"`
+		HTML string `json:"html" form:"html" binding:"required"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if reason := detectChallenge([]byte(req.HTML)); reason != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Page is a " + reason + ", not forum content"})
+		return
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(req.HTML))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse HTML: " + err.Error()})
+		return
+	}
+
+	src := sourceFor(req.URL)
+	var targets []string
+	if src.PostIDFromURL(req.URL) != "" {
+		targets = []string{req.URL}
+	} else {
+		for _, post := range src.Posts(doc, req.URL) {
+			targets = append(targets, post.URL)
+		}
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No posts found in the page"})
+		return
+	}
+
+	// Posts a queue worker is already processing are skipped rather than
+	// run twice at once.
+	var claimed, busy []string
+	var requestIDs []int
+	for _, target := range targets {
+		id, ok, err := claimRequest(target)
+		if err != nil {
+			// Fail what was already claimed rather than leave it processing
+			// with nothing to run it.
+			for i, id := range requestIDs {
+				finishRequest(id, claimed[i], err)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			busy = append(busy, target)
+			continue
+		}
+		claimed = append(claimed, target)
+		requestIDs = append(requestIDs, id)
+	}
+	if len(claimed) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Already being processed", "busy": busy})
+		return
+	}
+
+	go func() {
+		for i, target := range claimed {
+			log.Printf("Processing ingested request %d: %s", requestIDs[i], target)
+			_, _, err := processGalleryDocument(target, target, "", doc, nil)
+			finishRequest(requestIDs[i], target, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"message": "Ingest started", "requests": requestIDs, "busy": busy})
+}
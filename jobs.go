@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job types and statuses stored in the jobs table.
+const (
+	jobEnumerate     = "enumerate"
+	jobHashBackfill  = "hash_backfill"
+	jobPHashBackfill = "phash_backfill"
+
+	jobRunning     = "running"
+	jobCompleted   = "completed"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted" // still running when the server stopped
+)
+
+// maxJobErrors bounds how many error messages a job keeps.
+const maxJobErrors = 50
+
+// Job is a long-running background task whose progress is persisted and
+// pushed to websocket clients. For enumeration jobs Progress is pages read,
+// Total the thread's page count, Found the posts seen and Queued the posts
+// newly added to requests. For hash backfills Progress is photos processed,
+// Total the photos that had no hash and Found the duplicates replaced by links;
+// for perceptual hash backfills Found is the photos successfully hashed.
+type Job struct {
+	ID         int      `json:"id"`
+	Type       string   `json:"type"`
+	URL        string   `json:"url,omitempty"`
+	Status     string   `json:"status"`
+	Progress   int      `json:"progress"`
+	Total      int      `json:"total"`
+	Found      int      `json:"found"`
+	Queued     int      `json:"queued"`
+	Errors     []string `json:"errors"`
+	CreatedAt  string   `json:"createdAt"`
+	UpdatedAt  string   `json:"updatedAt"`
+	FinishedAt string   `json:"finishedAt,omitempty"`
+
+	mu sync.Mutex
+}
+
+func createJob(jobType, url string) (*Job, error) {
+	res, err := execWithRetry("INSERT INTO jobs (type, url, status) VALUES (?, ?, ?)", jobType, url, jobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s job: %v", jobType, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("getting job ID: %v", err)
+	}
+	return getJob(int(id))
+}
+
+const jobColumns = `id, type, url, status, progress, total, found, queued, errors, created_at, updated_at, finished_at`
+
+func getJob(id int) (*Job, error) {
+	var j Job
+	var url, errorsJSON, finishedAt sql.NullString
+	err := db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id).Scan(
+		&j.ID, &j.Type, &url, &j.Status, &j.Progress, &j.Total, &j.Found, &j.Queued,
+		&errorsJSON, &j.CreatedAt, &j.UpdatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.URL = url.String
+	j.FinishedAt = finishedAt.String
+	j.Errors = []string{}
+	if errorsJSON.Valid && errorsJSON.String != "" {
+		if err := json.Unmarshal([]byte(errorsJSON.String), &j.Errors); err != nil {
+			log.Printf("Failed to unmarshal errors for job %d: %v", j.ID, err)
+		}
+	}
+	return &j, nil
+}
+
+// addError records a non-fatal error on the job.
+func (j *Job) addError(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Errors) < maxJobErrors {
+		j.Errors = append(j.Errors, err.Error())
+	}
+}
+
+// save persists the job and pushes it to websocket clients.
+func (j *Job) save() {
+	j.mu.Lock()
+	errorsJSON, _ := json.Marshal(j.Errors)
+	snapshot, _ := json.Marshal(j)
+	finished := j.Status != jobRunning
+	_, err := execWithRetry(`
+		UPDATE jobs SET status = ?, progress = ?, total = ?, found = ?, queued = ?, errors = ?,
+			updated_at = CURRENT_TIMESTAMP,
+			finished_at = CASE WHEN ? THEN CURRENT_TIMESTAMP ELSE finished_at END
+		WHERE id = ?`,
+		j.Status, j.Progress, j.Total, j.Found, j.Queued, string(errorsJSON), finished, j.ID)
+	j.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save job %d: %v", j.ID, err)
+		return
+	}
+	broadcastEvent("job_progress", json.RawMessage(snapshot))
+}
+
+// finish marks the job done, failed if err is non-nil.
+func (j *Job) finish(err error) {
+	if err != nil {
+		j.addError(err)
+	}
+	j.mu.Lock()
+	j.Status = jobCompleted
+	if err != nil {
+		j.Status = jobFailed
+	}
+	j.mu.Unlock()
+	j.save()
+}
+
+// runEnumerationJob enumerates a thread, queueing each post as it is found.
+// Pages that fail to load are recorded on the job and skipped.
+func runEnumerationJob(j *Job) {
+	enumerator := &ThreadEnumerator{
+		OnPost: func(post ForumPost) error {
+			queued, err := queueRequest(post.URL)
+			j.mu.Lock()
+			j.Found++
+			if queued {
+				j.Queued++
+			}
+			j.mu.Unlock()
+			if err != nil {
+				j.addError(err)
+			}
+			return nil
+		},
+		OnPage: func(page, lastPage, posts int, err error) {
+			if err != nil {
+				j.addError(fmt.Errorf("page %d: %v", page, err))
+			}
+			j.mu.Lock()
+			j.Progress++
+			j.Total = lastPage
+			j.mu.Unlock()
+			j.save()
+		},
+	}
+	err := enumerator.Run(j.URL)
+	j.mu.Lock()
+	log.Printf("Enumeration job %d finished: %d posts found, %d queued", j.ID, j.Found, j.Queued)
+	j.mu.Unlock()
+	j.finish(err)
+}
+
+func getJobHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+	j, err := getJob(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+func listJobs(c *gin.Context) {
+	rows, err := db.Query(`SELECT id FROM jobs ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	jobs := []*Job{}
+	for _, id := range ids {
+		if j, err := getJob(id); err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+	c.JSON(http.StatusOK, jobs)
+}
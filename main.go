@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"io"
@@ -25,7 +26,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -63,8 +63,32 @@ func main() {
 
 	db = initDB()
 
+	if err := loadSiteCookies(); err != nil {
+		log.Fatalf("Failed to load site cookies: %v", err)
+	}
+	if err := loadSiteBlocks(); err != nil {
+		log.Fatalf("Failed to load site blocks: %v", err)
+	}
+	if err := loadSiteLimits(); err != nil {
+		log.Fatalf("Failed to load site limits: %v", err)
+	}
+	if err := loadSiteProxies(); err != nil {
+		log.Fatalf("Failed to load site proxies: %v", err)
+	}
+	if err := loadPlaceholders(); err != nil {
+		log.Fatalf("Failed to load placeholder images: %v", err)
+	}
+	if err := loadDeferredHosts(); err != nil {
+		log.Printf("Failed to load deferred images: %v", err)
+	}
+	go probeOpenCircuits(15 * time.Second)
+	if err := loadHostRules(); err != nil {
+		log.Printf("Using built-in rippers only: %v", err)
+	}
+	go watchHostRules(5 * time.Second)
+
 	// Retroactively create galleries for all processed requests
-	createMissingGalleriesForProcessedRequests()
+	go createMissingGalleriesForProcessedRequests()
 
 	go func() {
 		for {
@@ -76,6 +100,7 @@ func main() {
 	go taggingService()
 	// go colorExtractionService()
 	go processPendingDownloads() // New background service
+	go threadWatchService()
 
 	r := gin.Default()
 	r.Use(corsMiddleware())
@@ -95,6 +120,14 @@ func main() {
 	r.DELETE("/galleries/:id", deleteGallery)
 	r.PUT("/galleries/:id", updateGallery)                        // Route for deleting galleries
 	r.POST("/galleries/:id/assign-person", assignPersonToGallery) // Route for assigning person to gallery
+	r.POST("/galleries/:id/rename-auto", renameGalleryAuto)
+	r.PUT("/galleries/:id/studio", setGalleryStudio)
+	r.GET("/studios", listStudios)
+	r.POST("/studios", addStudio)
+	r.POST("/studios/detect", detectStudios)
+	r.GET("/studios/:id", getStudioHandler)
+	r.PUT("/studios/:id", updateStudio)
+	r.DELETE("/studios/:id", deleteStudio)
 	r.DELETE("/photos/:id", deletePhoto)
 
 	r.POST("/photos/:id/favorite", favoritePhoto)
@@ -108,84 +141,79 @@ func main() {
 	r.GET("/requests/pending", listPendingRequests) // New route for pending requests
 	r.GET("/photos/favorites", listFavoritePhotos)  // Route for favorite photos
 	r.DELETE("/requests/:id", deletePendingRequest)
+	r.GET("/hosts", listHosts)
+	r.PUT("/hosts/:name", updateHost)
+	r.POST("/hosts/reload", reloadHostRules)
+	r.GET("/sites/:host/cookies", listSiteCookies)
+	r.PUT("/sites/:host/cookies", putSiteCookies)
+	r.DELETE("/sites/:host/cookies", deleteSiteCookies)
+	r.POST("/cookies/import", importCookies)
+	r.GET("/sites/:host/credentials", getSiteCredentials)
+	r.PUT("/sites/:host/credentials", putSiteCredentials)
+	r.DELETE("/sites/:host/credentials", deleteSiteCredentials)
+	r.POST("/sites/:host/login", loginSite)
+	r.GET("/sites/blocked", listSiteBlocks)
+	r.POST("/sites/:host/resume", resumeSiteHandler)
+	r.GET("/sites/limits", listHostUsage)
+	r.GET("/sites/breakers", listBreakers)
+	r.POST("/sites/:host/breaker/reset", resetBreakerHandler)
+	r.PUT("/sites/:host/limits", putSiteLimits)
+	r.DELETE("/sites/:host/limits", deleteSiteLimits)
+	r.GET("/sites/:host/proxy", getSiteProxy)
+	r.PUT("/sites/:host/proxy", putSiteProxy)
+	r.DELETE("/sites/:host/proxy", deleteSiteProxy)
+	r.GET("/placeholders", listPlaceholders)
+	r.POST("/placeholders", addPlaceholder)
+	r.DELETE("/placeholders/:sha256", deletePlaceholder)
+	r.GET("/galleries/incomplete", listIncompleteGalleries)
+	r.GET("/requests/:id/attempts", listRequestAttempts)
+	r.POST("/requests/:id/retry", retryRequest)
+	r.POST("/threads/watch", watchThread)
+	r.GET("/threads/watches", listWatches)
+	r.PUT("/threads/watches/:id", updateWatch)
+	r.DELETE("/threads/watches/:id", deleteWatch)
+	r.POST("/threads/watches/:id/poll", pollWatchNow)
+	r.POST("/ingest/html", ingestHTML)
+	r.GET("/jobs", listJobs)
+	r.GET("/jobs/:id", getJobHandler)
+	r.GET("/duplicates", listDuplicates)
+	r.POST("/duplicates/backfill", startHashBackfill)
+	r.GET("/duplicates/similar", listSimilar)
+	r.POST("/duplicates/similar/backfill", startPHashBackfill)
+	r.POST("/duplicates/similar/keep-best", keepBestSimilar)
 
 	log.Fatal(r.Run(":8081"))
 }
 func createMissingGalleriesForProcessedRequests() {
-	rows, err := db.Query("SELECT id, url FROM requests WHERE status = 'completed'")
+	rows, err := db.Query("SELECT id, url FROM requests WHERE status IN ('completed', 'incomplete')")
 	if err != nil {
 		log.Printf("Error querying completed requests for gallery creation: %v", err)
 		return
 	}
-	defer rows.Close()
-
+	type request struct {
+		id  int
+		url string
+	}
+	var requests []request
 	for rows.Next() {
-		var id int
-		var url string
-		if err := rows.Scan(&id, &url); err != nil {
+		var r request
+		if err := rows.Scan(&r.id, &r.url); err != nil {
 			log.Printf("Error scanning completed request: %v", err)
 			continue
 		}
-		var exists int
-		err = db.QueryRow("SELECT COUNT(*) FROM galleries WHERE request_id = ?", id).Scan(&exists)
-		if err != nil {
-			log.Printf("Error checking gallery existence for request %d: %v", id, err)
-			continue
-		}
-		if exists == 0 {
-			// Try extractor service first, fallback to last URL segment
-			galleryName, err2 := callExtractName(url)
-			if err2 != nil || galleryName == "" {
-				galleryName = url
-				if idx := strings.LastIndex(galleryName, "/"); idx != -1 {
-					galleryName = galleryName[idx+1:]
-				}
-			}
-			_, err = db.Exec("INSERT INTO galleries (request_id, name) VALUES (?, ?)", id, galleryName)
-			if err != nil {
-				log.Printf("Error creating gallery for request %d: %v", id, err)
-			} else {
-				log.Printf("Retroactively created gallery for request %d with name '%s'", id, galleryName)
-			}
-		} else {
-			// If gallery exists, ensure it has a meaningful name. If name is empty or looks like a default (last URL segment), try extractor.
-			var currentName sql.NullString
-			err = db.QueryRow("SELECT name FROM galleries WHERE request_id = ?", id).Scan(&currentName)
-			if err == nil {
-				needUpdate := false
-				cur := strings.TrimSpace(currentName.String)
-				if cur == "" {
-					needUpdate = true
-				} else {
-					// compare to last part of URL
-					last := url
-					if idx := strings.LastIndex(last, "/"); idx != -1 {
-						last = last[idx+1:]
-					}
-					if cur == last || cur == url {
-						needUpdate = true
-					}
-					// If the current name looks like JSON (raw extractor response), re-run extractor
-					if strings.HasPrefix(cur, "{") || strings.HasPrefix(cur, "[") || strings.Contains(cur, "\"album\"") {
-						needUpdate = true
-					}
-				}
-				if needUpdate {
-					if newName, err2 := callExtractName(url); err2 == nil && strings.TrimSpace(newName) != "" {
-						_, _ = db.Exec("UPDATE galleries SET name = ? WHERE request_id = ?", newName, id)
-						log.Printf("Updated gallery name for request %d to '%s'", id, newName)
-					}
-				}
-			}
+		requests = append(requests, r)
+	}
+	rows.Close()
+
+	// Creates missing galleries and renames ones still carrying a default
+	// name. This runs on every start, so it sticks to the local extractors.
+	for _, r := range requests {
+		if err := ensureGalleryWith(r.id, NameInput{URL: r.url}, extractLocalGalleryName); err != nil {
+			log.Printf("Error ensuring gallery for request %d: %v", r.id, err)
 		}
 	}
 }
 
-// callExtractName contacts the local extractor service running on port 9090
-// It POSTs JSON {"title": <url>} and returns the extracted name.
-func callExtractName(urlStr string) (string, error) {
-	return "", fmt.Errorf("empty extractor response")
-}
 func addPerson(c *gin.Context) {
 	var req Person
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -288,6 +316,81 @@ func updatePerson(c *gin.Context) {
 	c.JSON(http.StatusOK, person)
 }
 
+// ensureGallery creates the gallery for a request, named by the extractor
+// chain. An existing gallery whose name is still a default is renamed once
+// the chain can do better, e.g. after the post metadata was stored.
+func ensureGallery(requestID int, in NameInput) error {
+	return ensureGalleryWith(requestID, in, extractGalleryName)
+}
+
+func ensureGalleryWith(requestID int, in NameInput, extract func(NameInput) ExtractedName) error {
+	var galleryID int
+	var current, title, text sql.NullString
+	err := db.QueryRow("SELECT id, name, thread_title, post_text FROM galleries WHERE request_id = ?", requestID).Scan(&galleryID, &current, &title, &text)
+	if err == sql.ErrNoRows {
+		name := extract(in)
+		if _, err := execWithRetry("INSERT INTO galleries (request_id, name) VALUES (?, ?)", requestID, name.Name); err != nil {
+			return err
+		}
+		log.Printf("Created gallery for request %d with name '%s' (%s)", requestID, name.Name, name.Extractor)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("checking gallery existence for request %d: %v", requestID, err)
+	}
+
+	if !isDefaultGalleryName(current.String, in.URL) {
+		return nil
+	}
+	if in.ThreadTitle == "" {
+		in.ThreadTitle = title.String
+	}
+	if in.PostText == "" {
+		in.PostText = text.String
+	}
+	name := extract(in)
+	if name.Extractor == (urlSegmentExtractor{}).Name() || name.Name == current.String {
+		return nil
+	}
+	if _, err := execWithRetry("UPDATE galleries SET name = ? WHERE id = ?", name.Name, galleryID); err != nil {
+		return err
+	}
+	log.Printf("Renamed gallery %d for request %d to '%s' (%s)", galleryID, requestID, name.Name, name.Extractor)
+	return nil
+}
+
+// finishRequest records the outcome of processing a request: back to pending
+// if its site is blocked, failed, or completed/incomplete with a gallery.
+func finishRequest(requestID int, requestURL string, err error) {
+	incomplete := errors.Is(err, ErrIncompleteGallery)
+	if errors.Is(err, ErrSiteBlocked) {
+		// Leave it for when the site is resumed. An ingested page is not
+		// fetched by the queue, so it fails instead.
+		log.Printf("Returning request %d to pending: %v", requestID, err)
+		if _, err := db.Exec("UPDATE requests SET status = CASE WHEN ingested THEN 'failed' ELSE 'pending' END WHERE id = ?", requestID); err != nil {
+			log.Printf("Error returning request %d to pending: %v", requestID, err)
+		}
+	} else if err != nil && !incomplete {
+		log.Printf("Failed to process URL %s: %v", requestURL, err)
+		_, err = db.Exec("UPDATE requests SET status = 'failed' WHERE id = ?", requestID)
+		if err != nil {
+			log.Printf("Error marking request %d as failed: %v", requestID, err)
+		}
+	} else {
+		if err := ensureGallery(requestID, NameInput{URL: requestURL}); err != nil {
+			log.Printf("Error creating gallery for request %d: %v", requestID, err)
+		}
+		status := "completed"
+		if incomplete {
+			status = "incomplete"
+		}
+		_, err = db.Exec("UPDATE requests SET status = ? WHERE id = ?", status, requestID)
+		if err != nil {
+			log.Printf("Error marking request %d as %s: %v", requestID, status, err)
+		}
+		log.Printf("Finished request %d as %s: %s", requestID, status, requestURL)
+	}
+}
+
 func processPendingDownloads() {
 	jobs := make(chan struct {
 		id  int
@@ -308,48 +411,15 @@ func processPendingDownloads() {
 				// Process the URL
 				log.Printf("Processing request %d: %s", job.id, job.url)
 				err = processURL(job.url)
-				if err != nil {
-					log.Printf("Failed to process URL %s: %v", job.url, err)
-					_, err = db.Exec("UPDATE requests SET status = 'failed' WHERE id = ?", job.id)
-					if err != nil {
-						log.Printf("Error marking request %d as failed: %v", job.id, err)
-					}
-				} else {
-					// Create a gallery entry for this request if not exists
-					var exists int
-					err = db.QueryRow("SELECT COUNT(*) FROM galleries WHERE request_id = ?", job.id).Scan(&exists)
-					if err != nil {
-						log.Printf("Error checking gallery existence for request %d: %v", job.id, err)
-					}
-					if exists == 0 {
-						// Try extractor service first, fallback to last URL segment
-						galleryName, err2 := callExtractName(job.url)
-						if err2 != nil || galleryName == "" {
-							galleryName = job.url
-							if idx := strings.LastIndex(galleryName, "/"); idx != -1 {
-								galleryName = galleryName[idx+1:]
-							}
-						}
-						_, err = db.Exec("INSERT INTO galleries (request_id, name) VALUES (?, ?)", job.id, galleryName)
-						if err != nil {
-							log.Printf("Error creating gallery for request %d: %v", job.id, err)
-						} else {
-							log.Printf("Created gallery for request %d with name '%s'", job.id, galleryName)
-						}
-					}
-					_, err = db.Exec("UPDATE requests SET status = 'completed' WHERE id = ?", job.id)
-					if err != nil {
-						log.Printf("Error marking request %d as completed: %v", job.id, err)
-					}
-					log.Printf("Completed processing request %d: %s", job.id, job.url)
-				}
+				finishRequest(job.id, job.url, err)
 			}
 		}()
 	}
 
 	// Producer: fetch jobs and send to workers
 	for {
-		rows, err := db.Query("SELECT id, url FROM requests WHERE status = 'pending' LIMIT 10")
+		filter, args := blockedHostFilter()
+		rows, err := db.Query("SELECT id, url FROM requests WHERE status = 'pending' AND NOT ingested"+filter+" LIMIT 10", args...)
 		if err != nil {
 			log.Printf("Error querying pending requests: %v", err)
 			time.Sleep(10 * time.Second)
@@ -528,90 +598,38 @@ func queueDownloads(c *gin.Context) {
 	}
 
 	if strings.HasSuffix(req.URL, "[range]") {
+		// Large threads take minutes to walk, so enumeration runs as a job
+		// and posts are queued as each page is read.
 		baseUrl := strings.TrimSuffix(req.URL, "[range]")
-		postUrls, err := enumerateAllPostUrls(baseUrl)
+		job, err := createJob(jobEnumerate, baseUrl)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enumerate posts: " + err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enumeration: " + err.Error()})
 			return
 		}
-		count := 0
-		for _, postUrl := range postUrls {
-			_, err := db.Exec(
-				"INSERT INTO requests (url, created_at, status) VALUES (?, ?, 'pending') ON CONFLICT(url) DO NOTHING",
-				postUrl, time.Now().Format(time.RFC3339),
-			)
-			if err == nil {
-				count++
-			}
-		}
-		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Queued %d posts for download", count)})
+		go runEnumerationJob(job)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Enumeration started", "jobId": job.ID})
 		return
 	}
 
 	// Single post as before
-	_, err := db.Exec(
-		"INSERT INTO requests (url, created_at, status) VALUES (?, ?, 'pending') ON CONFLICT(url) DO NOTHING",
-		req.URL, time.Now().Format(time.RFC3339),
-	)
+	queued, err := queueRequest(req.URL)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue download: " + err.Error()})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Download queued"})
-}
-
-// Helper: enumerate all post URLs in a thread (across all pages)
-func enumerateAllPostUrls(baseUrl string) ([]string, error) {
-	var postUrls []string
-	seen := make(map[string]bool)
-	page := 1
-	for {
-		pageUrl := baseUrl
-		if page > 1 {
-			if strings.Contains(baseUrl, "?") {
-				pageUrl = fmt.Sprintf("%s&page=%d", baseUrl, page)
-			} else {
-				pageUrl = fmt.Sprintf("%s/page%d", strings.TrimRight(baseUrl, "/"), page)
-			}
-		}
-		resp, err := http.Get(pageUrl)
-		if err != nil {
-			return nil, fmt.Errorf("fetching %s: %v", pageUrl, err)
-		}
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("reading %s: %v", pageUrl, err)
+	if !queued {
+		// A failed browser ingest goes back through the normal queue.
+		requestID, err := requestIDForURL(req.URL)
+		if err == nil {
+			_, err = requeueIngested(requestID)
 		}
-		doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
 		if err != nil {
-			return nil, fmt.Errorf("parsing HTML from %s: %v", pageUrl, err)
-		}
-
-		foundNew := false
-		doc.Find("div[id^='post_message_']").Each(func(_ int, s *goquery.Selection) {
-			id, exists := s.Attr("id")
-			if !exists || seen[id] {
-				return
-			}
-			seen[id] = true
-			foundNew = true
-			// Compose post URL using the actual pageUrl (not baseUrl)
-			postUrl := pageUrl
-			if strings.Contains(pageUrl, "#") {
-				postUrl = strings.Split(pageUrl, "#")[0]
-			}
-			postUrl = fmt.Sprintf("%s#%s", postUrl, id)
-			postUrls = append(postUrls, postUrl)
-		})
-
-		if !foundNew {
-			break // No new posts found, stop
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue download: " + err.Error()})
+			return
 		}
-		page++
 	}
-	return postUrls, nil
+
+	c.JSON(http.StatusOK, gin.H{"message": "Download queued"})
 }
 
 func listPhotos(c *gin.Context) {
@@ -621,6 +639,8 @@ func listPhotos(c *gin.Context) {
 	galleryIDStr := c.Query("gallery_id")
 	tag := c.Query("tag")
 	color := c.Query("color")
+	mediaType := c.Query("media_type")
+	studioIDStr := c.Query("studio_id")
 
 	page, _ := strconv.Atoi(pageStr)
 	if page < 1 {
@@ -632,7 +652,7 @@ func listPhotos(c *gin.Context) {
 	}
 
 	query := `
-        SELECT p.id, p.request_id, p.url, p.file_path, p.thumbnail_path, p.created_at, 
+        SELECT p.id, p.request_id, p.url, p.file_path, p.thumbnail_path, p.created_at, p.media_type,
                GROUP_CONCAT(pe.name, ','), GROUP_CONCAT(pc.color_hex, ',') 
         FROM photos p 
         LEFT JOIN photo_tags pt ON p.file_path = pt.photo_path 
@@ -644,6 +664,7 @@ func listPhotos(c *gin.Context) {
 	countQuery := "SELECT COUNT(DISTINCT p.file_path) FROM photos p"
 	whereClauses := []string{}
 	args := []interface{}{}
+	countJoinsGalleries := false
 
 	// Filter by person_id
 	if personIDStr != "" {
@@ -665,6 +686,22 @@ func listPhotos(c *gin.Context) {
 			// Ensure countQuery also joins through requests -> galleries when filtering by gallery
 			countQuery += " LEFT JOIN requests r ON p.request_id = r.id"
 			countQuery += " LEFT JOIN galleries g ON r.id = g.request_id"
+			countJoinsGalleries = true
+		}
+	}
+
+	// Filter by studio_id (the studio of the photo's gallery)
+	if studioIDStr != "" {
+		studioID, err := strconv.Atoi(studioIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid studio_id"})
+			return
+		}
+		whereClauses = append(whereClauses, "g.studio_id = ?")
+		args = append(args, studioID)
+		if !countJoinsGalleries {
+			countQuery += " LEFT JOIN requests r ON p.request_id = r.id"
+			countQuery += " LEFT JOIN galleries g ON r.id = g.request_id"
 		}
 	}
 
@@ -695,6 +732,18 @@ func listPhotos(c *gin.Context) {
 		args = append(args, r, g, b)
 	}
 
+	// Filter by media type (image, animated, video)
+	if mediaType != "" {
+		switch mediaType {
+		case mediaImage, mediaAnimated, mediaVideo:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media_type"})
+			return
+		}
+		whereClauses = append(whereClauses, "p.media_type = ?")
+		args = append(args, mediaType)
+	}
+
 	if len(whereClauses) > 0 {
 		query += " WHERE " + strings.Join(whereClauses, " AND ")
 		countQuery += " WHERE " + strings.Join(whereClauses, " AND ")
@@ -717,7 +766,7 @@ func listPhotos(c *gin.Context) {
 	for rows.Next() {
 		var p PhotoWithTagsAndColors
 		var tags, colors sql.NullString
-		if err := rows.Scan(&p.Id, &p.RequestID, &p.URL, &p.Path, &p.Thumbnail, &p.CreatedAt, &tags, &colors); err != nil {
+		if err := rows.Scan(&p.Id, &p.RequestID, &p.URL, &p.Path, &p.Thumbnail, &p.CreatedAt, &p.MediaType, &tags, &colors); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -992,12 +1041,30 @@ func setProfilePhoto(c *gin.Context) {
 }
 
 type GalleryWithPeople struct {
-	ID        int      `json:"id"`
-	Name      string   `json:"name"`
-	URL       string   `json:"url"`
-	CreatedAt string   `json:"createdAt"`
-	Thumbnail string   `json:"thumbnail,omitempty"`
-	People    []Person `json:"people"`
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	URL         string         `json:"url"`
+	CreatedAt   string         `json:"createdAt"`
+	Thumbnail   string         `json:"thumbnail,omitempty"`
+	ThreadTitle string         `json:"threadTitle,omitempty"`
+	PostAuthor  string         `json:"postAuthor,omitempty"`
+	PostedAt    string         `json:"postedAt,omitempty"`
+	PostText    string         `json:"postText,omitempty"`
+	Studio      *StudioSummary `json:"studio,omitempty"`
+	People      []Person       `json:"people"`
+}
+
+// parseDateParam accepts YYYY-MM-DD or RFC 3339 and returns it in the RFC 3339
+// form posted_at is stored in, so the two compare as strings.
+func parseDateParam(value string) (string, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339), nil
 }
 
 func listGalleries(c *gin.Context) {
@@ -1006,12 +1073,15 @@ func listGalleries(c *gin.Context) {
 	var galleries []GalleryWithPeople
 
 	query := `
-        SELECT DISTINCT g.id, g.name, r.url, r.created_at, MIN(p.thumbnail_path) as thumbnail
+        SELECT DISTINCT g.id, g.name, r.url, r.created_at, MIN(p.thumbnail_path) as thumbnail,
+               g.thread_title, g.post_author, g.posted_at, g.post_text, s.id, s.name
         FROM galleries g
 		JOIN requests r ON g.request_id = r.id
         JOIN photos p ON r.id = p.request_id
+		LEFT JOIN studios s ON g.studio_id = s.id
     `
 	var args []interface{}
+	var conditions []string
 
 	if personIDStr != "" {
 		personID, err := strconv.Atoi(personIDStr)
@@ -1021,14 +1091,63 @@ func listGalleries(c *gin.Context) {
 		}
 		query += `
 			JOIN photo_tags pt ON p.file_path = pt.photo_path
-			WHERE pt.person_id = ?
 		`
+		conditions = append(conditions, "pt.person_id = ?")
 		args = append(args, personID)
 	}
 
+	if studioIDStr := c.Query("studio_id"); studioIDStr != "" {
+		studioID, err := strconv.Atoi(studioIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid studio_id"})
+			return
+		}
+		conditions = append(conditions, "g.studio_id = ?")
+		args = append(args, studioID)
+	}
+
+	// posted_after is inclusive, posted_before exclusive, both on the
+	// original post date.
+	for _, f := range []struct{ param, op string }{{"posted_after", ">="}, {"posted_before", "<"}} {
+		value := c.Query(f.param)
+		if value == "" {
+			continue
+		}
+		date, err := parseDateParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + f.param + ": use YYYY-MM-DD or RFC 3339"})
+			return
+		}
+		conditions = append(conditions, "g.posted_at "+f.op+" ?")
+		args = append(args, date)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	orderBy := "r.created_at"
+	switch c.DefaultQuery("sort", "created_at") {
+	case "created_at":
+	case "posted_at":
+		// Galleries without a known post date sort last either way.
+		orderBy = "g.posted_at IS NULL, g.posted_at"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort: use created_at or posted_at"})
+		return
+	}
+	direction := "DESC"
+	switch strings.ToLower(c.DefaultQuery("order", "desc")) {
+	case "desc":
+	case "asc":
+		direction = "ASC"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order: use asc or desc"})
+		return
+	}
+
 	query += `
 		GROUP BY r.id, r.url, r.created_at
-		ORDER BY r.created_at DESC
+		ORDER BY ` + orderBy + ` ` + direction + `
 	`
 
 	rows, err := db.Query(query, args...)
@@ -1044,8 +1163,9 @@ func listGalleries(c *gin.Context) {
 
 	for rows.Next() {
 		var g GalleryWithPeople
-		var thumbnail sql.NullString
-		if err := rows.Scan(&g.ID, &g.Name, &g.URL, &g.CreatedAt, &thumbnail); err != nil {
+		var thumbnail, threadTitle, postAuthor, postedAt, postText, studioName sql.NullString
+		var studioID sql.NullInt64
+		if err := rows.Scan(&g.ID, &g.Name, &g.URL, &g.CreatedAt, &thumbnail, &threadTitle, &postAuthor, &postedAt, &postText, &studioID, &studioName); err != nil {
 			log.Printf("Scan failed: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1053,6 +1173,13 @@ func listGalleries(c *gin.Context) {
 		if thumbnail.Valid {
 			g.Thumbnail = thumbnail.String
 		}
+		g.ThreadTitle = threadTitle.String
+		g.PostAuthor = postAuthor.String
+		g.PostedAt = postedAt.String
+		g.PostText = postText.String
+		if studioID.Valid {
+			g.Studio = &StudioSummary{ID: int(studioID.Int64), Name: studioName.String}
+		}
 		g.People = []Person{}
 		galleries = append(galleries, g)
 		galleryMap[g.ID] = &galleries[len(galleries)-1]
@@ -1138,6 +1265,24 @@ func handleWebSocket(c *gin.Context) {
 	}
 }
 
+// broadcastEvent sends {"event": event, "data": data} to every websocket client.
+func broadcastEvent(event string, data interface{}) {
+	message, err := json.Marshal(gin.H{"event": event, "data": data})
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", event, err)
+		return
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for conn := range clients {
+		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			log.Printf("WebSocket write error: %v", err)
+			conn.Close()
+			delete(clients, conn)
+		}
+	}
+}
+
 func broadcastNewPhoto() {
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
@@ -1159,13 +1304,14 @@ func checkAndRedownloadMissingFiles() error {
 	type photo struct {
 		url      string
 		filePath string
+		sha256   string
 	}
 
 	var photos []photo
 
 	// 1. Query favorited photos first
 	favRows, err := db.Query(`
-        SELECT p.url, p.file_path
+        SELECT p.url, p.file_path, COALESCE(p.sha256, '')
         FROM photos p
         JOIN favorites f ON p.id = f.photo_id
         ORDER BY f.created_at DESC
@@ -1175,15 +1321,15 @@ func checkAndRedownloadMissingFiles() error {
 	}
 	defer favRows.Close()
 	for favRows.Next() {
-		var url, filePath string
-		if err := favRows.Scan(&url, &filePath); err == nil {
-			photos = append(photos, photo{url: url, filePath: filePath})
+		var p photo
+		if err := favRows.Scan(&p.url, &p.filePath, &p.sha256); err == nil {
+			photos = append(photos, p)
 		}
 	}
 
 	// 2. Query all other photos (excluding those already in the list)
 	allRows, err := db.Query(`
-        SELECT url, file_path
+        SELECT url, file_path, COALESCE(sha256, '')
         FROM photos
         ORDER BY created_at DESC
     `)
@@ -1196,10 +1342,10 @@ func checkAndRedownloadMissingFiles() error {
 		seen[p.filePath] = true
 	}
 	for allRows.Next() {
-		var url, filePath string
-		if err := allRows.Scan(&url, &filePath); err == nil {
-			if !seen[filePath] {
-				photos = append(photos, photo{url: url, filePath: filePath})
+		var p photo
+		if err := allRows.Scan(&p.url, &p.filePath, &p.sha256); err == nil {
+			if !seen[p.filePath] {
+				photos = append(photos, p)
 			}
 		}
 	}
@@ -1207,7 +1353,7 @@ func checkAndRedownloadMissingFiles() error {
 	// Filter missing files
 	var tasks []photo
 	for _, p := range photos {
-		if _, err := os.Stat(p.filePath); os.IsNotExist(err) {
+		if !fileDownloaded(p.filePath) {
 			tasks = append(tasks, p)
 		}
 	}
@@ -1226,18 +1372,47 @@ func checkAndRedownloadMissingFiles() error {
 	for _, task := range tasks {
 		wg.Add(1)
 		sem <- struct{}{}
-		go func(url, filePath string) {
+		go func(url, filePath, sum string) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			log.Printf("File missing: %s, redownloading from %s", filePath, url)
-			if err := DownloadFile(url, filePath); err != nil {
-				log.Printf("Failed to redownload %s: %v", url, err)
-				mu.Lock()
-				errors = append(errors, fmt.Errorf("redownload %s: %v", url, err))
-				mu.Unlock()
+			// Queue workers may be writing the same file.
+			lock := downloadPathLock(filePath)
+			lock.Lock()
+			defer lock.Unlock()
+			if fileDownloaded(filePath) {
 				return
 			}
-			log.Printf("Redownloaded %s to %s", url, filePath)
+			// Another photo with the same content saves a download.
+			relinked := false
+			if sum != "" {
+				if original, ok := existingCopy(sum, filePath); ok {
+					_ = os.MkdirAll(filepath.Dir(filePath), 0755)
+					if err := linkInPlace(original, filePath); err != nil {
+						log.Printf("Relinking %s to %s failed: %v", filePath, original, err)
+					} else {
+						log.Printf("File missing: %s, relinked to identical %s", filePath, original)
+						relinked = true
+					}
+				}
+			}
+			if !relinked {
+				log.Printf("File missing: %s, redownloading from %s", filePath, url)
+				newSum, err := DownloadFile(url, filePath)
+				if err != nil {
+					log.Printf("Failed to redownload %s: %v", url, err)
+					mu.Lock()
+					errors = append(errors, fmt.Errorf("redownload %s: %v", url, err))
+					mu.Unlock()
+					return
+				}
+				log.Printf("Redownloaded %s to %s", url, filePath)
+				dedupeFile(filePath, newSum)
+				if newSum != sum {
+					if _, err := execWithRetry("UPDATE photos SET sha256 = ? WHERE file_path = ?", newSum, filePath); err != nil {
+						log.Printf("Error updating hash of %s: %v", filePath, err)
+					}
+				}
+			}
 			filename := path.Base(filePath)
 			directory := filepath.Dir(filePath)
 			thumbnailDir := directory + "/thumbnails"
@@ -1249,7 +1424,11 @@ func checkAndRedownloadMissingFiles() error {
 				return
 			}
 			thumbnailPath := fmt.Sprintf("%s/thumb_%s", thumbnailDir, filename)
-			if err := generateThumbnail(filePath, thumbnailPath); err != nil {
+			mediaType, err := detectMediaType(filePath)
+			if err != nil {
+				mediaType = mediaImage
+			}
+			if thumbnailPath, err = generateMediaThumbnail(filePath, thumbnailPath, mediaType); err != nil {
 				log.Printf("Error generating thumbnail for %s: %v", filePath, err)
 				mu.Lock()
 				errors = append(errors, fmt.Errorf("generate thumbnail %s: %v", filePath, err))
@@ -1257,7 +1436,7 @@ func checkAndRedownloadMissingFiles() error {
 			} else {
 				log.Printf("Generated thumbnail: %s", thumbnailPath)
 			}
-		}(task.url, task.filePath)
+		}(task.url, task.filePath, task.sha256)
 	}
 
 	wg.Wait()
@@ -1290,7 +1469,7 @@ func corsMiddleware() gin.HandlerFunc {
 func processURL(url string) error {
 	fmt.Printf("Processing URL: %s\n", url)
 	if err := DownloadGallery(url, url, ""); err != nil {
-		return fmt.Errorf("error downloading gallery %s: %v", url, err)
+		return fmt.Errorf("error downloading gallery %s: %w", url, err)
 	}
 	return nil
 }
@@ -1371,39 +1550,57 @@ func deletePhoto(c *gin.Context) {
 		return
 	}
 
-	// Get file and thumbnail paths
-	var filePath, thumbPath string
-	err = db.QueryRow("SELECT file_path, thumbnail_path FROM photos WHERE id = ?", photoID).Scan(&filePath, &thumbPath)
+	err = removePhoto(photoID)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
 		return
 	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query photo: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Photo deleted"})
+}
+
+// removePhoto deletes a photo with its tags, colors and favorite, and its
+// files unless another photo row still uses them. It returns sql.ErrNoRows
+// for an unknown photo.
+func removePhoto(photoID int) error {
+	// Get file and thumbnail paths
+	var filePath, thumbPath string
+	err := db.QueryRow("SELECT file_path, thumbnail_path FROM photos WHERE id = ?", photoID).Scan(&filePath, &thumbPath)
+	if err == sql.ErrNoRows {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Failed to query photo: %v", err)
+	}
+
 	// Delete files from disk
-	_ = os.Remove(filePath)
-	_ = os.Remove(thumbPath)
+	var shared int
+	_ = db.QueryRow("SELECT COUNT(*) FROM photos WHERE file_path = ? AND id != ?", filePath, photoID).Scan(&shared)
+	if shared == 0 {
+		_ = os.Remove(filePath)
+		_ = os.Remove(thumbPath)
+	}
 
-	// Delete from DB (tags, colors, photo)
+	// Delete from DB (tags, colors, favorite, photo)
 	tx, err := db.Begin()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
-		return
+		return fmt.Errorf("Failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
-	_, _ = tx.Exec("DELETE FROM photo_tags WHERE photo_path = ?", filePath)
-	_, _ = tx.Exec("DELETE FROM photo_colors WHERE photo_path = ?", filePath)
+	if shared == 0 {
+		_, _ = tx.Exec("DELETE FROM photo_tags WHERE photo_path = ?", filePath)
+		_, _ = tx.Exec("DELETE FROM photo_colors WHERE photo_path = ?", filePath)
+	}
+	_, _ = tx.Exec("DELETE FROM favorites WHERE photo_id = ?", photoID)
 	_, _ = tx.Exec("DELETE FROM photos WHERE id = ?", photoID)
 
 	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
-		return
+		return fmt.Errorf("Failed to commit transaction: %v", err)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Photo deleted"})
+	return nil
 }
 
 func updateGallery(c *gin.Context) {
@@ -1891,7 +2088,7 @@ func listFavoritePhotos(c *gin.Context) {
 	}
 
 	query := `
-        SELECT p.id, p.request_id, p.url, p.file_path, p.thumbnail_path, p.created_at,
+        SELECT p.id, p.request_id, p.url, p.file_path, p.thumbnail_path, p.created_at, p.media_type,
                GROUP_CONCAT(DISTINCT pe.name) as tags,
                GROUP_CONCAT(DISTINCT pc.color_hex) as colors
         FROM photos p
@@ -1915,7 +2112,7 @@ func listFavoritePhotos(c *gin.Context) {
 		var p PhotoWithTagsAndColors
 		var tags, colors sql.NullString
 		err := rows.Scan(&p.Id, &p.RequestID, &p.URL, &p.Path, &p.Thumbnail,
-			&p.CreatedAt, &tags, &colors)
+			&p.CreatedAt, &p.MediaType, &tags, &colors)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1978,6 +2175,7 @@ type PhotoWithTagsAndColors struct {
 	Path      string   `json:"Path"`
 	Thumbnail string   `json:"Thumbnail"`
 	CreatedAt string   `json:"CreatedAt"`
+	MediaType string   `json:"MediaType,omitempty"`
 	Tags      []string `json:"Tags"`
 	Colors    []string `json:"Colors"`
 	Favorited bool     `json:"favorited"`
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Values of photos.media_type.
+const (
+	mediaImage    = "image"
+	mediaAnimated = "animated"
+	mediaVideo    = "video"
+)
+
+// detectMediaType sniffs a downloaded file and reports whether it is a still
+// image, an animated image (GIF, APNG, animated WebP) or a video.
+func detectMediaType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	switch {
+	case strings.HasPrefix(contentType, "video/"), isMP4(head), isMatroska(head):
+		return mediaVideo, nil
+	case contentType == "image/gif":
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		g, err := gif.DecodeAll(f)
+		if err == nil && len(g.Image) > 1 {
+			return mediaAnimated, nil
+		}
+		return mediaImage, nil
+	case contentType == "image/png" && bytes.Contains(head, []byte("acTL")):
+		return mediaAnimated, nil
+	case contentType == "image/webp" && bytes.Contains(head, []byte("ANIM")):
+		return mediaAnimated, nil
+	}
+	return mediaImage, nil
+}
+
+// isMP4 matches the ISO base media "ftyp" box, which http.DetectContentType
+// only recognises for a few brands. HEIC and AVIF stills use the same
+// container and are told apart by their major brand.
+func isMP4(head []byte) bool {
+	return len(head) >= 12 && string(head[4:8]) == "ftyp" && !isHEIF(head)
+}
+
+// heifBrands are the major brands of HEIF still images (HEIC, AVIF).
+var heifBrands = map[string]bool{"heic": true, "heix": true, "heim": true, "heis": true, "mif1": true, "avif": true}
+
+func isHEIF(head []byte) bool {
+	return len(head) >= 12 && string(head[4:8]) == "ftyp" && heifBrands[string(head[8:12])]
+}
+
+func isMatroska(head []byte) bool {
+	return len(head) >= 4 && bytes.Equal(head[:4], []byte{0x1A, 0x45, 0xDF, 0xA3})
+}
+
+// generateMediaThumbnail writes a static thumbnail for any media type and
+// returns its path. Videos get a poster frame extracted with ffmpeg, saved
+// next to destPath with a .jpg extension since the source extension is not
+// an image format.
+func generateMediaThumbnail(srcPath, destPath, mediaType string) (string, error) {
+	switch mediaType {
+	case mediaVideo:
+		poster := destPath + ".jpg"
+		if err := generateVideoPoster(srcPath, poster); err != nil {
+			return "", err
+		}
+		return poster, nil
+	case mediaAnimated:
+		// imaging.Open decodes only the first frame, which is what we want
+		// for a still poster; the animated original is served untouched.
+		// Animated WebP cannot be decoded, so it gets a placeholder.
+		if strings.EqualFold(filepath.Ext(destPath), ".webp") {
+			poster := destPath + ".png"
+			return poster, writePlaceholderPoster(poster)
+		}
+	}
+	err := generateThumbnail(srcPath, destPath)
+	if errors.Is(err, image.ErrFormat) {
+		// No decoder for the format (HEIC, AVIF): the original is kept
+		// and gets a placeholder, like animated WebP.
+		poster := destPath + ".png"
+		return poster, writePlaceholderPoster(poster)
+	}
+	return destPath, err
+}
+
+// generateVideoPoster grabs a frame one second in (or the first frame for
+// very short clips). Without ffmpeg a neutral placeholder is written so the
+// video still shows up in the gallery.
+func generateVideoPoster(srcPath, destPath string) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		fmt.Printf("ffmpeg not found, writing placeholder poster for %s\n", srcPath)
+		return writePlaceholderPoster(destPath)
+	}
+	for _, offset := range []string{"1", "0"} {
+		cmd := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-ss", offset, "-i", srcPath,
+			"-frames:v", "1", "-vf", "scale=200:-2", destPath)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			if info, statErr := os.Stat(destPath); statErr == nil && info.Size() > 0 {
+				return nil
+			}
+		}
+		fmt.Printf("ffmpeg poster at %ss failed for %s: %v %s\n", offset, srcPath, err, strings.TrimSpace(string(out)))
+	}
+	return fmt.Errorf("extracting poster frame from %s", srcPath)
+}
+
+func writePlaceholderPoster(destPath string) error {
+	img := imaging.New(200, 112, color.NRGBA{R: 40, G: 40, B: 40, A: 255})
+	if err := imaging.Save(img, destPath); err != nil {
+		return fmt.Errorf("saving placeholder poster %s: %v", destPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ftyp builds the start of an ISO base media file with the given major brand.
+func ftyp(brand string) []byte {
+	return append([]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p'}, []byte(brand+"\x00\x00\x00\x00mif1miaf")...)
+}
+
+func TestIsMP4AndHEIF(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		mp4  bool
+		heif bool
+	}{
+		{"isom", ftyp("isom"), true, false},
+		{"mp42", ftyp("mp42"), true, false},
+		{"quicktime", ftyp("qt  "), true, false},
+		{"heic", ftyp("heic"), false, true},
+		{"heix", ftyp("heix"), false, true},
+		{"mif1", ftyp("mif1"), false, true},
+		{"avif", ftyp("avif"), false, true},
+		{"too short", []byte("\x00\x00\x00\x18ftyp"), false, false},
+		{"no ftyp box", []byte("\x00\x00\x00\x18moovisom"), false, false},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), false, false},
+	}
+	for _, tt := range tests {
+		if got := isMP4(tt.head); got != tt.mp4 {
+			t.Errorf("isMP4(%s) = %v, want %v", tt.name, got, tt.mp4)
+		}
+		if got := isHEIF(tt.head); got != tt.heif {
+			t.Errorf("isHEIF(%s) = %v, want %v", tt.name, got, tt.heif)
+		}
+	}
+}
+
+func TestDetectMediaType(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	}
+	encodeGIF := func(frames int) []byte {
+		g := &gif.GIF{}
+		for i := 0; i < frames; i++ {
+			g.Image = append(g.Image, frame())
+			g.Delay = append(g.Delay, 10)
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	var stillPNG bytes.Buffer
+	if err := png.Encode(&stillPNG, img); err != nil {
+		t.Fatal(err)
+	}
+	// An animation control chunk right after IHDR makes a PNG an APNG.
+	apng := append(append([]byte{}, stillPNG.Bytes()[:33]...), []byte("\x00\x00\x00\x08acTL\x00\x00\x00\x02\x00\x00\x00\x00")...)
+	apng = append(apng, stillPNG.Bytes()[33:]...)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"still png", stillPNG.Bytes(), mediaImage},
+		{"apng", apng, mediaAnimated},
+		{"single frame gif", encodeGIF(1), mediaImage},
+		{"animated gif", encodeGIF(3), mediaAnimated},
+		{"still webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 \x18\x00\x00\x00"), mediaImage},
+		{"animated webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00ANIM"), mediaAnimated},
+		{"mp4", ftyp("isom"), mediaVideo},
+		{"heic", ftyp("heic"), mediaImage},
+		{"avif", ftyp("avif"), mediaImage},
+		{"matroska", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x01, 0x00, 0x00, 0x00}, mediaVideo},
+		{"empty file", nil, mediaImage},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := detectMediaType(path)
+		if err != nil {
+			t.Errorf("detectMediaType(%s): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("detectMediaType(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := detectMediaType(filepath.Join(dir, "missing")); err == nil {
+		t.Error("detectMediaType of a missing file succeeded")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NameInput is what a NameExtractor gets to work with. It is also the JSON
+// body POSTed to the HTTP extractor.
+type NameInput struct {
+	URL         string `json:"url"`
+	ThreadTitle string `json:"threadTitle,omitempty"`
+	PostText    string `json:"postText,omitempty"`
+}
+
+// ExtractedName is a gallery name and, where the extractor could tell, its
+// parts. It is also the JSON response expected from the HTTP extractor.
+type ExtractedName struct {
+	Name      string   `json:"name"`
+	Studio    string   `json:"studio,omitempty"`
+	People    []string `json:"people,omitempty"`
+	Set       string   `json:"set,omitempty"`
+	Extractor string   `json:"extractor"`
+}
+
+// NameExtractor derives a gallery name. Extractors return errNoName when the
+// input does not fit them so the chain moves on to the next one.
+type NameExtractor interface {
+	Name() string
+	Extract(in NameInput) (ExtractedName, error)
+}
+
+var errNoName = errors.New("no name extracted")
+
+// nameExtractors run in order; the URL segment extractor always succeeds and
+// stays last.
+var nameExtractors []NameExtractor
+
+func init() {
+	nameExtractors = append(nameExtractors, titleRulesExtractor{})
+	if u := envOr("NAME_EXTRACTOR_URL", ""); u != "" {
+		timeout := envSeconds("NAME_EXTRACTOR_TIMEOUT_SECONDS", 5*time.Second)
+		nameExtractors = append(nameExtractors, &httpNameExtractor{url: u, client: &http.Client{Timeout: timeout}})
+	}
+	nameExtractors = append(nameExtractors, urlSegmentExtractor{})
+}
+
+// extractGalleryName runs the extractor chain and returns the first name.
+func extractGalleryName(in NameInput) ExtractedName {
+	return extractNameWith(nameExtractors, in)
+}
+
+// extractLocalGalleryName runs the chain without the HTTP extractor, for
+// bulk passes that would otherwise make a network call per gallery.
+func extractLocalGalleryName(in NameInput) ExtractedName {
+	var local []NameExtractor
+	for _, ex := range nameExtractors {
+		if _, remote := ex.(*httpNameExtractor); !remote {
+			local = append(local, ex)
+		}
+	}
+	return extractNameWith(local, in)
+}
+
+func extractNameWith(extractors []NameExtractor, in NameInput) ExtractedName {
+	for _, ex := range extractors {
+		name, err := ex.Extract(in)
+		if err != nil {
+			if err != errNoName {
+				log.Printf("Name extractor %s failed for %s: %v", ex.Name(), in.URL, err)
+			}
+			continue
+		}
+		name.Name = strings.TrimSpace(name.Name)
+		if name.Name == "" || looksLikeJunkName(name.Name) {
+			continue
+		}
+		name.Extractor = ex.Name()
+		return name
+	}
+	return ExtractedName{Name: lastURLSegment(in.URL), Extractor: urlSegmentExtractor{}.Name()}
+}
+
+// looksLikeJunkName catches raw extractor responses stored as names.
+func looksLikeJunkName(name string) bool {
+	return strings.HasPrefix(name, "{") || strings.HasPrefix(name, "[") || strings.Contains(name, `"album"`)
+}
+
+func lastURLSegment(rawURL string) string {
+	if idx := strings.LastIndex(rawURL, "/"); idx != -1 {
+		return rawURL[idx+1:]
+	}
+	return rawURL
+}
+
+// isDefaultGalleryName reports whether a gallery still has a name nobody
+// chose: empty, the URL or its last segment, or junk.
+func isDefaultGalleryName(name, rawURL string) bool {
+	name = strings.TrimSpace(name)
+	return name == "" || name == rawURL || name == lastURLSegment(rawURL) || looksLikeJunkName(name)
+}
+
+// titleRulesExtractor parses thread titles of the form
+// "Studio - Person - Set Name" or "Person - Set Name". People joined with
+// "&", "and" or "," are split.
+type titleRulesExtractor struct{}
+
+var (
+	titleSeparatorRe = regexp.MustCompile(`\s+[-–—|]\s+`)
+	// Bracketed notes and image/resolution counts that are not part of the name.
+	titleNoiseRe     = regexp.MustCompile(`(?i)\s*(\[[^\]]*\]|\([^)]*\)|\b\d+\s*(?:pics|photos|images)\b|\bx\s*\d+\b|\b\d{3,4}\s*(?:px|p)\b|\b\d{3,4}x\d{3,4}\b)`)
+	titlePeopleSepRe = regexp.MustCompile(`\s*(?:&|,|\band\b)\s*`)
+)
+
+func (titleRulesExtractor) Name() string { return "title-rules" }
+
+func (titleRulesExtractor) Extract(in NameInput) (ExtractedName, error) {
+	title := cleanText(titleNoiseRe.ReplaceAllString(in.ThreadTitle, " "))
+	if title == "" {
+		return ExtractedName{}, errNoName
+	}
+	var parts []string
+	for _, p := range titleSeparatorRe.Split(title, -1) {
+		if p = strings.Trim(strings.TrimSpace(p), "-–—|"); p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	var name ExtractedName
+	var person string
+	switch {
+	case len(parts) >= 3:
+		name.Studio, person, name.Set = parts[0], parts[1], strings.Join(parts[2:], " - ")
+	case len(parts) == 2:
+		person, name.Set = parts[0], parts[1]
+	default:
+		return ExtractedName{}, errNoName
+	}
+	for _, p := range titlePeopleSepRe.Split(person, -1) {
+		if p = strings.TrimSpace(p); p != "" {
+			name.People = append(name.People, p)
+		}
+	}
+	name.Name = strings.Join(parts, " - ")
+	return name, nil
+}
+
+// httpNameExtractor delegates to an external service configured with
+// NAME_EXTRACTOR_URL. The service receives a NameInput as JSON and answers
+// 200 with an ExtractedName; an empty name or any other status means it had
+// nothing to offer.
+type httpNameExtractor struct {
+	url    string
+	client *http.Client
+}
+
+func (*httpNameExtractor) Name() string { return "http" }
+
+func (e *httpNameExtractor) Extract(in NameInput) (ExtractedName, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return ExtractedName{}, err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return ExtractedName{}, fmt.Errorf("calling %s: %v", e.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound {
+		return ExtractedName{}, errNoName
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ExtractedName{}, fmt.Errorf("unexpected status %s from %s", resp.Status, e.url)
+	}
+	var out ExtractedName
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return ExtractedName{}, fmt.Errorf("decoding response from %s: %v", e.url, err)
+	}
+	if strings.TrimSpace(out.Name) == "" {
+		return ExtractedName{}, errNoName
+	}
+	return out, nil
+}
+
+// urlSegmentExtractor names the gallery after the last segment of the URL.
+type urlSegmentExtractor struct{}
+
+func (urlSegmentExtractor) Name() string { return "url-segment" }
+
+func (urlSegmentExtractor) Extract(in NameInput) (ExtractedName, error) {
+	return ExtractedName{Name: lastURLSegment(in.URL)}, nil
+}
+
+// galleryNameInput loads what the chain needs for an existing gallery.
+func galleryNameInput(galleryID int) (NameInput, string, error) {
+	var in NameInput
+	var name, title, text sql.NullString
+	err := db.QueryRow(`SELECT g.name, r.url, g.thread_title, g.post_text
+		FROM galleries g JOIN requests r ON g.request_id = r.id WHERE g.id = ?`, galleryID).Scan(&name, &in.URL, &title, &text)
+	in.ThreadTitle = title.String
+	in.PostText = text.String
+	return in, name.String, err
+}
+
+// renameGalleryAuto re-runs the name extractor chain for a gallery.
+func renameGalleryAuto(c *gin.Context) {
+	galleryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gallery id"})
+		return
+	}
+	in, oldName, err := galleryNameInput(galleryID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gallery not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := extractGalleryName(in)
+	if _, err := execWithRetry("UPDATE galleries SET name = ? WHERE id = ?", name.Name, galleryID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Renamed gallery %d from '%s' to '%s' (%s)", galleryID, oldName, name.Name, name.Extractor)
+	c.JSON(http.StatusOK, gin.H{"id": galleryID, "oldName": oldName, "name": name})
+}
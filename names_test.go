@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTitleRulesExtractor(t *testing.T) {
+	tests := []struct {
+		title string
+		want  ExtractedName
+		err   error
+	}{
+		{
+			title: "Studio X - Jane Doe - Beach Day",
+			want:  ExtractedName{Name: "Studio X - Jane Doe - Beach Day", Studio: "Studio X", People: []string{"Jane Doe"}, Set: "Beach Day"},
+		},
+		{
+			title: "Jane Doe & Mary Roe - Beach Day",
+			want:  ExtractedName{Name: "Jane Doe & Mary Roe - Beach Day", People: []string{"Jane Doe", "Mary Roe"}, Set: "Beach Day"},
+		},
+		{
+			title: "Studio X | Ann, Bea and Cat | Poolside - Part 2",
+			want:  ExtractedName{Name: "Studio X - Ann, Bea and Cat - Poolside - Part 2", Studio: "Studio X", People: []string{"Ann", "Bea", "Cat"}, Set: "Poolside - Part 2"},
+		},
+		{
+			title: "Jane Doe – Beach Day [120 pics] (3000x2000) x120",
+			want:  ExtractedName{Name: "Jane Doe - Beach Day", People: []string{"Jane Doe"}, Set: "Beach Day"},
+		},
+		{
+			title: "Studio X — Jane Doe — Beach Day 150 photos 1080p",
+			want:  ExtractedName{Name: "Studio X - Jane Doe - Beach Day", Studio: "Studio X", People: []string{"Jane Doe"}, Set: "Beach Day"},
+		},
+		{title: "Just a title", err: errNoName},
+		{title: "Well-known-hyphenated-name", err: errNoName},
+		{title: "[HQ] (2025)", err: errNoName},
+		{title: "", err: errNoName},
+	}
+	for _, tt := range tests {
+		got, err := titleRulesExtractor{}.Extract(NameInput{ThreadTitle: tt.title})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Extract(%q) error = %v, want %v", tt.title, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Extract(%q) = %+v, want %+v", tt.title, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSimilarDistance is the Hamming distance between perceptual hashes
+// up to which two photos count as the same picture. Resized and recompressed
+// copies usually differ by a handful of bits out of 64.
+const defaultSimilarDistance = 6
+
+// imageFingerprint is a photo's perceptual hash and pixel size.
+type imageFingerprint struct {
+	hash   uint64
+	width  int
+	height int
+}
+
+// fingerprintImage decodes the image at path (the first frame of an
+// animation) and computes its difference hash.
+func fingerprintImage(path string) (*imageFingerprint, error) {
+	img, err := imaging.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening image %s: %v", path, err)
+	}
+	bounds := img.Bounds()
+
+	// dHash: shrink to 9x8 grey pixels and record, for each row, whether
+	// brightness falls or rises between neighbours. That survives scaling,
+	// recompression and small colour shifts.
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return &imageFingerprint{hash: hash, width: bounds.Dx(), height: bounds.Dy()}, nil
+}
+
+func formatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parsePHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// runPHashBackfillJob fingerprints every still or animated photo stored
+// before photos had perceptual hashes. Like the SHA-256 backfill it only
+// looks at photos without one, so it can be run again after an interruption.
+func runPHashBackfillJob(j *Job) {
+	type photo struct {
+		id   int
+		path string
+	}
+	rows, err := db.Query("SELECT id, file_path FROM photos WHERE phash IS NULL AND media_type != ? ORDER BY id", mediaVideo)
+	if err != nil {
+		j.finish(fmt.Errorf("querying photos: %v", err))
+		return
+	}
+	var photos []photo
+	for rows.Next() {
+		var p photo
+		var path sql.NullString
+		if err := rows.Scan(&p.id, &path); err != nil {
+			rows.Close()
+			j.finish(fmt.Errorf("scanning photo: %v", err))
+			return
+		}
+		p.path = path.String
+		photos = append(photos, p)
+	}
+	rows.Close()
+
+	j.mu.Lock()
+	j.Total = len(photos)
+	j.mu.Unlock()
+	j.save()
+
+	for i, p := range photos {
+		if !fileDownloaded(p.path) {
+			j.addError(fmt.Errorf("photo %d: file %s is missing", p.id, p.path))
+		} else if fp, err := fingerprintImage(p.path); err != nil {
+			j.addError(fmt.Errorf("photo %d: %v", p.id, err))
+		} else if _, err := execWithRetry("UPDATE photos SET phash = ?, width = ?, height = ? WHERE id = ?",
+			formatPHash(fp.hash), fp.width, fp.height, p.id); err != nil {
+			j.addError(fmt.Errorf("photo %d: %v", p.id, err))
+		} else {
+			j.mu.Lock()
+			j.Found++
+			j.mu.Unlock()
+		}
+		j.mu.Lock()
+		j.Progress++
+		j.mu.Unlock()
+		if (i+1)%50 == 0 {
+			j.save()
+		}
+	}
+	j.mu.Lock()
+	log.Printf("Perceptual hash backfill job %d finished: %d of %d photos hashed", j.ID, j.Found, j.Progress)
+	j.mu.Unlock()
+	j.finish(nil)
+}
+
+func startPHashBackfill(c *gin.Context) {
+	var running int
+	if err := db.QueryRow("SELECT COUNT(*) FROM jobs WHERE type = ? AND status = ?", jobPHashBackfill, jobRunning).Scan(&running); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if running > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A perceptual hash backfill is already running"})
+		return
+	}
+	job, err := createJob(jobPHashBackfill, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go runPHashBackfillJob(job)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Perceptual hash backfill started", "jobId": job.ID})
+}
+
+// SimilarPhoto is one member of a group of near-duplicate photos. Distance
+// is the Hamming distance from the group's first, best photo.
+type SimilarPhoto struct {
+	DuplicatePhoto
+	Width    int `json:"width"`
+	Height   int `json:"height"`
+	Distance int `json:"distance"`
+
+	hash uint64
+}
+
+type SimilarGroup struct {
+	KeepID int            `json:"keepId"`
+	Count  int            `json:"count"`
+	Photos []SimilarPhoto `json:"photos"`
+}
+
+// maxSimilarDistance bounds the distance the band index can search
+// efficiently; looser matches are mostly unrelated photos anyway.
+const maxSimilarDistance = 10
+
+// hashBands indexes perceptual hashes by their four 16-bit bands. Two hashes
+// within distance d agree to within d/4 bits on at least one band, so a
+// search only looks at buckets within that many bit flips of each band.
+type hashBands struct {
+	buckets [4][][]int
+	hashes  []uint64
+	flips   []uint16 // every 16-bit mask with at most d/4 bits set
+}
+
+func newHashBands(distance int) *hashBands {
+	b := &hashBands{}
+	for i := range b.buckets {
+		b.buckets[i] = make([][]int, 1<<16)
+	}
+	for mask := 0; mask < 1<<16; mask++ {
+		if bits.OnesCount16(uint16(mask)) <= distance/4 {
+			b.flips = append(b.flips, uint16(mask))
+		}
+	}
+	return b
+}
+
+func band(hash uint64, i int) uint16 {
+	return uint16(hash >> (16 * i))
+}
+
+// add stores hash as entry number len(b.hashes).
+func (b *hashBands) add(hash uint64) {
+	n := len(b.hashes)
+	b.hashes = append(b.hashes, hash)
+	for i := range b.buckets {
+		b.buckets[i][band(hash, i)] = append(b.buckets[i][band(hash, i)], n)
+	}
+}
+
+// nearest returns the lowest entry within distance of hash and its distance,
+// or -1 when there is none.
+func (b *hashBands) nearest(hash uint64, distance int) (int, int) {
+	best, bestDistance := -1, 0
+	for i := range b.buckets {
+		for _, flip := range b.flips {
+			for _, n := range b.buckets[i][band(hash, i)^flip] {
+				if best >= 0 && n >= best {
+					continue
+				}
+				if d := bits.OnesCount64(b.hashes[n] ^ hash); d <= distance {
+					best, bestDistance = n, d
+				}
+			}
+		}
+	}
+	return best, bestDistance
+}
+
+// groupSimilar groups photos, which must come best first (most pixels, then
+// oldest). Each photo joins the earliest group whose leading photo is within
+// distance, so every member is within distance of the photo that would be
+// kept; chaining A~B~C never pulls in a C that looks nothing like A. Group
+// leaders are indexed by hash band, so a photo is compared with a few nearby
+// leaders rather than all of them.
+func groupSimilar(photos []SimilarPhoto, distance int) []SimilarGroup {
+	var groups []SimilarGroup
+	leaders := newHashBands(distance)
+	for _, p := range photos {
+		if p.hash == 0 {
+			// Flat images all hash to zero whatever their colour; exact
+			// copies of them are still found by SHA-256.
+			continue
+		}
+		if g, d := leaders.nearest(p.hash, distance); g >= 0 {
+			p.Distance = d
+			groups[g].Photos = append(groups[g].Photos, p)
+			continue
+		}
+		groups = append(groups, SimilarGroup{Photos: []SimilarPhoto{p}})
+		leaders.add(p.hash)
+	}
+
+	var similar []SimilarGroup
+	for _, g := range groups {
+		if len(g.Photos) > 1 {
+			g.KeepID = g.Photos[0].ID
+			g.Count = len(g.Photos)
+			similar = append(similar, g)
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Count > similar[j].Count })
+	return similar
+}
+
+// The last grouping is kept until the set of fingerprinted photos changes,
+// so paging through the groups does not regroup the library every time.
+var similarCache struct {
+	sync.Mutex
+	key    string
+	groups []SimilarGroup
+}
+
+// similarGroups returns the near-duplicate groups at distance.
+func similarGroups(distance int) ([]SimilarGroup, error) {
+	var count, maxID, sumID int64
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(SUM(id), 0)
+		FROM photos WHERE phash IS NOT NULL`).Scan(&count, &maxID, &sumID); err != nil {
+		return nil, fmt.Errorf("counting photo hashes: %v", err)
+	}
+	key := fmt.Sprintf("%d/%d/%d/%d", distance, count, maxID, sumID)
+	similarCache.Lock()
+	defer similarCache.Unlock()
+	if similarCache.key == key {
+		return similarCache.groups, nil
+	}
+
+	rows, err := db.Query(`SELECT p.id, p.request_id, g.id, g.name, p.url, p.file_path, p.thumbnail_path,
+		p.phash, COALESCE(p.width, 0), COALESCE(p.height, 0)
+		FROM photos p LEFT JOIN galleries g ON g.request_id = p.request_id
+		WHERE p.phash IS NOT NULL
+		ORDER BY COALESCE(p.width, 0) * COALESCE(p.height, 0) DESC, p.id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying photo hashes: %v", err)
+	}
+	defer rows.Close()
+
+	var photos []SimilarPhoto
+	for rows.Next() {
+		var p SimilarPhoto
+		var galleryID sql.NullInt64
+		var galleryName, url, thumbnail sql.NullString
+		var phash string
+		if err := rows.Scan(&p.ID, &p.RequestID, &galleryID, &galleryName, &url, &p.FilePath, &thumbnail,
+			&phash, &p.Width, &p.Height); err != nil {
+			return nil, fmt.Errorf("scanning photo: %v", err)
+		}
+		if p.hash, err = parsePHash(phash); err != nil {
+			log.Printf("Skipping photo %d with bad perceptual hash %q", p.ID, phash)
+			continue
+		}
+		if galleryID.Valid {
+			id := int(galleryID.Int64)
+			p.GalleryID = &id
+		}
+		p.GalleryName = galleryName.String
+		p.URL = url.String
+		p.ThumbnailPath = thumbnail.String
+		photos = append(photos, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := groupSimilar(photos, distance)
+	similarCache.key, similarCache.groups = key, groups
+	return groups, nil
+}
+
+// similarDistance reads the distance query parameter.
+func similarDistance(c *gin.Context) (int, error) {
+	distance, err := strconv.Atoi(c.DefaultQuery("distance", strconv.Itoa(defaultSimilarDistance)))
+	if err != nil || distance < 0 || distance > maxSimilarDistance {
+		return 0, fmt.Errorf("distance must be between 0 and %d", maxSimilarDistance)
+	}
+	return distance, nil
+}
+
+// listSimilar returns groups of near-duplicate photos, largest first. Each
+// group's first photo is the highest-resolution copy, the one keep-best
+// would keep.
+func listSimilar(c *gin.Context) {
+	distance, err := similarDistance(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "50"))
+	if perPage < 1 {
+		perPage = 50
+	}
+
+	groups, err := similarGroups(distance)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	total := len(groups)
+	start := min((page-1)*perPage, total)
+	end := min(start+perPage, total)
+	c.JSON(http.StatusOK, gin.H{
+		"distance":    distance,
+		"groups":      append([]SimilarGroup{}, groups[start:end]...),
+		"page":        page,
+		"per_page":    perPage,
+		"total":       total,
+		"total_pages": (total + perPage - 1) / perPage,
+	})
+}
+
+// keepBestSimilar keeps the highest-resolution photo of near-duplicate
+// groups and deletes the others. Only the groups named by keepIds (the photo
+// each group keeps, as listed by GET /duplicates/similar) are touched, or
+// every group with confirm; without either, or with dry_run=true, nothing is
+// deleted and the response lists what would be. If a deleted copy was a
+// favorite, the kept one becomes a favorite instead.
+func keepBestSimilar(c *gin.Context) {
+	distance, err := similarDistance(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		KeepIDs []int `json:"keepIds"`
+		Confirm bool  `json:"confirm"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true" || (len(req.KeepIDs) == 0 && !req.Confirm)
+
+	groups, err := similarGroups(distance)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	selected := groups
+	errs := []string{}
+	if len(req.KeepIDs) > 0 {
+		byKeepID := make(map[int]SimilarGroup, len(groups))
+		for _, g := range groups {
+			byKeepID[g.KeepID] = g
+		}
+		selected = nil
+		for _, id := range req.KeepIDs {
+			g, ok := byKeepID[id]
+			if !ok {
+				// The library changed since the groups were listed.
+				errs = append(errs, fmt.Sprintf("photo %d does not lead a group at distance %d", id, distance))
+				continue
+			}
+			selected = append(selected, g)
+		}
+	}
+
+	kept := []int{}
+	deleted := []int{}
+	for _, g := range selected {
+		kept = append(kept, g.KeepID)
+		for _, p := range g.Photos[1:] {
+			if dryRun {
+				deleted = append(deleted, p.ID)
+				continue
+			}
+			var favorite int
+			_ = db.QueryRow("SELECT COUNT(*) FROM favorites WHERE photo_id = ?", p.ID).Scan(&favorite)
+			if err := removePhoto(p.ID); err != nil {
+				errs = append(errs, fmt.Sprintf("photo %d: %v", p.ID, err))
+				continue
+			}
+			deleted = append(deleted, p.ID)
+			if favorite > 0 {
+				if _, err := execWithRetry("INSERT OR IGNORE INTO favorites (photo_id) VALUES (?)", g.KeepID); err != nil {
+					errs = append(errs, fmt.Sprintf("favoriting photo %d: %v", g.KeepID, err))
+				}
+			}
+		}
+	}
+	if !dryRun {
+		log.Printf("Keep-best at distance %d: kept %d photos, deleted %d", distance, len(kept), len(deleted))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"distance": distance,
+		"dryRun":   dryRun,
+		"kept":     kept,
+		"deleted":  deleted,
+		"errors":   errs,
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestFingerprintImage(t *testing.T) {
+	dir := t.TempDir()
+	save := func(name string, img image.Image) string {
+		path := filepath.Join(dir, name)
+		if err := imaging.Save(img, path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gradient := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	blocks := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			v := uint8((x*255/400 + y*128/300) / 2)
+			gradient.Set(x, y, color.NRGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+			b := uint8(0)
+			if (x/50+y/50)%2 == 0 {
+				b = 255
+			}
+			blocks.Set(x, y, color.NRGBA{R: b, G: b, B: b, A: 255})
+		}
+	}
+	original := save("original.png", gradient)
+	resized := save("resized.jpg", imaging.Resize(gradient, 200, 150, imaging.Lanczos))
+	other := save("other.png", blocks)
+	flat := save("flat.png", imaging.New(64, 64, color.NRGBA{R: 200, A: 255}))
+	notImage := filepath.Join(dir, "notimage.png")
+	if err := os.WriteFile(notImage, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := func(path string) *imageFingerprint {
+		fp, err := fingerprintImage(path)
+		if err != nil {
+			t.Fatalf("fingerprintImage(%s): %v", filepath.Base(path), err)
+		}
+		return fp
+	}
+	orig := fingerprint(original)
+	if orig.width != 400 || orig.height != 300 {
+		t.Errorf("size = %dx%d, want 400x300", orig.width, orig.height)
+	}
+	if fp := fingerprint(flat); fp.hash != 0 {
+		t.Errorf("flat image hash = %s, want 0", formatPHash(fp.hash))
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		near   bool
+		width  int
+		height int
+	}{
+		{"resized copy", resized, true, 200, 150},
+		{"different picture", other, false, 400, 300},
+	}
+	for _, tt := range tests {
+		fp := fingerprint(tt.path)
+		d := bits.OnesCount64(fp.hash ^ orig.hash)
+		if near := d <= defaultSimilarDistance; near != tt.near {
+			t.Errorf("%s: distance %d, want near=%v", tt.name, d, tt.near)
+		}
+		if fp.width != tt.width || fp.height != tt.height {
+			t.Errorf("%s: size = %dx%d, want %dx%d", tt.name, fp.width, fp.height, tt.width, tt.height)
+		}
+	}
+
+	if _, err := fingerprintImage(notImage); err == nil {
+		t.Error("fingerprintImage of a non-image succeeded")
+	}
+}
+
+func TestPHashRoundTrip(t *testing.T) {
+	for _, hash := range []uint64{0, 1, 0xdeadbeef, 1<<64 - 1} {
+		s := formatPHash(hash)
+		if len(s) != 16 {
+			t.Errorf("formatPHash(%x) = %q, want 16 digits", hash, s)
+		}
+		if got, err := parsePHash(s); err != nil || got != hash {
+			t.Errorf("parsePHash(%q) = %x, %v; want %x", s, got, err, hash)
+		}
+	}
+}
+
+func TestGroupSimilar(t *testing.T) {
+	photo := func(id int, hash uint64) SimilarPhoto {
+		return SimilarPhoto{DuplicatePhoto: DuplicatePhoto{ID: id}, hash: hash}
+	}
+	type member struct{ id, distance int }
+	tests := []struct {
+		name     string
+		photos   []SimilarPhoto
+		distance int
+		want     [][]member
+	}{
+		{
+			name:     "exact copies at distance 0",
+			photos:   []SimilarPhoto{photo(1, 0xff00), photo(2, 0xff01), photo(3, 0xff00)},
+			distance: 0,
+			want:     [][]member{{{1, 0}, {3, 0}}},
+		},
+		{
+			name:     "members are within distance of the leader, not of each other",
+			photos:   []SimilarPhoto{photo(1, 0xf0f0), photo(2, 0xf0f7), photo(3, 0xf3f7)},
+			distance: 4,
+			want:     [][]member{{{1, 0}, {2, 3}}},
+		},
+		{
+			name:     "a photo near two leaders joins the earlier one",
+			photos:   []SimilarPhoto{photo(1, 0x0f), photo(2, 0xf0), photo(3, 0xff), photo(4, 0xf1)},
+			distance: 4,
+			want:     [][]member{{{1, 0}, {3, 4}}, {{2, 0}, {4, 1}}},
+		},
+		{
+			name:     "flat images and singletons are left out",
+			photos:   []SimilarPhoto{photo(1, 0), photo(2, 0), photo(3, 1<<63)},
+			distance: 6,
+			want:     nil,
+		},
+		{
+			name: "larger groups first",
+			photos: []SimilarPhoto{
+				photo(1, 0xaaaa000000000000), photo(2, 0xaaaa000000000001),
+				photo(3, 0x5555), photo(4, 0x5557), photo(5, 0x555f),
+			},
+			distance: 6,
+			want:     [][]member{{{3, 0}, {4, 1}, {5, 2}}, {{1, 0}, {2, 1}}},
+		},
+		{
+			name:     "bands split across the whole hash",
+			photos:   []SimilarPhoto{photo(1, 0x0001000100010001), photo(2, 0x0001000100010000)},
+			distance: 1,
+			want:     [][]member{{{1, 0}, {2, 1}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]member
+			for _, g := range groupSimilar(tt.photos, tt.distance) {
+				if g.KeepID != g.Photos[0].ID || g.Count != len(g.Photos) {
+					t.Errorf("group keepId %d count %d for %d photos led by %d", g.KeepID, g.Count, len(g.Photos), g.Photos[0].ID)
+				}
+				var members []member
+				for _, p := range g.Photos {
+					members = append(members, member{p.ID, p.Distance})
+				}
+				got = append(got, members)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHashBandsNearest checks the band index against a linear scan, with
+// hashes clustered so that most searches have matches near the limit.
+func TestHashBandsNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var hashes []uint64
+	for len(hashes) < 2000 {
+		base := rng.Uint64()
+		for i := 0; i < 5; i++ {
+			h := base
+			for flips := rng.Intn(maxSimilarDistance + 3); flips > 0; flips-- {
+				h ^= 1 << rng.Intn(64)
+			}
+			hashes = append(hashes, h)
+		}
+	}
+	for distance := 0; distance <= maxSimilarDistance; distance++ {
+		index := newHashBands(distance)
+		for i, h := range hashes {
+			wantEntry, wantDistance := -1, 0
+			for n, other := range index.hashes {
+				if d := bits.OnesCount64(other ^ h); d <= distance {
+					wantEntry, wantDistance = n, d
+					break
+				}
+			}
+			entry, d := index.nearest(h, distance)
+			if entry != wantEntry || d != wantDistance {
+				t.Fatalf("distance %d, hash %d: nearest = %d (%d), want %d (%d)", distance, i, entry, d, wantEntry, wantDistance)
+			}
+			if entry < 0 {
+				index.add(h)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PostMeta is what we know about the post a gallery was downloaded from.
+type PostMeta struct {
+	ThreadTitle string
+	Author      string
+	PostedAt    time.Time // zero when the date could not be read
+	Text        string
+}
+
+var whitespaceRe = regexp.MustCompile(`\s+`)
+
+// cleanText collapses the whitespace of text extracted from HTML.
+func cleanText(s string) string {
+	return strings.TrimSpace(whitespaceRe.ReplaceAllString(s, " "))
+}
+
+// postDateLayouts are the date formats vBulletin boards commonly use, most
+// common first.
+var postDateLayouts = []string{
+	"01-02-2006, 3:04 PM",
+	"01-02-2006 3:04 PM",
+	"02-01-2006, 03:04 PM",
+	"01-02-2006, 15:04",
+	"02-01-2006, 15:04",
+	"02.01.2006, 15:04",
+	"2006-01-02, 3:04 PM",
+	"2006-01-02, 15:04",
+	"2006-01-02 15:04",
+	"Jan 2, 2006, 3:04 PM",
+	"Jan 2, 2006 3:04 PM",
+	"01-02-2006",
+	"2006-01-02",
+}
+
+var postDateRe = regexp.MustCompile(`(?i)(today|yesterday|\d{1,4}[-./]\d{1,2}[-./]\d{2,4}|[a-z]{3} \d{1,2}, \d{4})(,? \d{1,2}:\d{2}(?: ?[ap]m)?)?`)
+
+// parsePostDate finds a post date in free text such as "03-14-2025, 10:15 PM"
+// or "Today, 09:12 AM". Forum times have no zone, so they are taken as UTC.
+func parsePostDate(text string, now time.Time) (time.Time, bool) {
+	m := postDateRe.FindStringSubmatch(cleanText(text))
+	if m == nil {
+		return time.Time{}, false
+	}
+	day := m[1]
+	clock := strings.ToUpper(strings.TrimLeft(m[2], ", "))
+	if n := len(clock); n > 2 && (strings.HasSuffix(clock, "AM") || strings.HasSuffix(clock, "PM")) && clock[n-3] != ' ' {
+		clock = clock[:n-2] + " " + clock[n-2:]
+	}
+
+	switch strings.ToLower(day) {
+	case "today":
+		day = now.UTC().Format("2006-01-02")
+	case "yesterday":
+		day = now.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	candidates := []string{day}
+	if clock != "" {
+		candidates = []string{day + ", " + clock, day + " " + clock, day}
+	}
+	for _, candidate := range candidates {
+		for _, layout := range postDateLayouts {
+			if t, err := time.Parse(layout, candidate); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// saveGalleryMetadata stores post metadata on the request's gallery,
+// creating the gallery (named from the thread title) if it does not exist yet.
+func saveGalleryMetadata(requestID int, requestURL string, meta PostMeta) error {
+	in := NameInput{URL: requestURL, ThreadTitle: meta.ThreadTitle, PostText: meta.Text}
+	if err := ensureGallery(requestID, in); err != nil {
+		return err
+	}
+	if err := assignStudio(requestID, in); err != nil {
+		log.Printf("Studio detection failed for request %d: %v", requestID, err)
+	}
+	var postedAt interface{}
+	if !meta.PostedAt.IsZero() {
+		postedAt = meta.PostedAt.UTC().Format(time.RFC3339)
+	}
+	_, err := execWithRetry(`UPDATE galleries SET thread_title = ?, post_author = ?, posted_at = ?, post_text = ? WHERE request_id = ?`,
+		meta.ThreadTitle, meta.Author, postedAt, meta.Text, requestID)
+	if err != nil {
+		return fmt.Errorf("saving post metadata for request %d: %v", requestID, err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePostDate(t *testing.T) {
+	now := time.Date(2025, 3, 20, 18, 30, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		text string
+		want time.Time
+		ok   bool
+	}{
+		{"03-14-2025, 10:15 PM", date(2025, 3, 14, 22, 15), true},
+		{"Posted 03-14-2025 9:05 AM by someone", date(2025, 3, 14, 9, 5), true},
+		{"25-03-2025, 09:15 PM", date(2025, 3, 25, 21, 15), true},
+		{"03-14-2025, 22:15", date(2025, 3, 14, 22, 15), true},
+		{"14-03-2025, 22:15", date(2025, 3, 14, 22, 15), true},
+		{"14.03.2025, 22:15", date(2025, 3, 14, 22, 15), true},
+		{"2025-03-14, 10:15 PM", date(2025, 3, 14, 22, 15), true},
+		{"2025-03-14 22:15", date(2025, 3, 14, 22, 15), true},
+		{"Mar 14, 2025, 10:15 PM", date(2025, 3, 14, 22, 15), true},
+		{"Mar 14, 2025 10:15pm", date(2025, 3, 14, 22, 15), true},
+		{"03-14-2025", date(2025, 3, 14, 0, 0), true},
+		{"2025-03-14", date(2025, 3, 14, 0, 0), true},
+		{"Today, 09:12 AM", date(2025, 3, 20, 9, 12), true},
+		{"yesterday 11:40 PM", date(2025, 3, 19, 23, 40), true},
+		{"  Today,\n   09:12 AM ", date(2025, 3, 20, 9, 12), true},
+		{"no date here", time.Time{}, false},
+		{"99-99-2025", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parsePostDate(tt.text, now)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parsePostDate(%q) = %v, %v; want %v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
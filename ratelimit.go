@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default per-host limits, overridable with HOST_RPS and HOST_MAX_IN_FLIGHT
+// and per site with PUT /sites/:host/limits.
+var (
+	defaultHostRPS         = envFloat("HOST_RPS", 2)
+	defaultHostMaxInFlight = envInt("HOST_MAX_IN_FLIGHT", 4)
+)
+
+// hostLimiter spaces requests to one host at most rps per second and caps the
+// requests in flight. A request holds its slot until its body is closed.
+type hostLimiter struct {
+	mu          sync.Mutex
+	freed       chan struct{} // closed and replaced whenever a slot may have come free
+	rps         float64
+	maxInFlight int
+	custom      bool // limits come from site_limits rather than the defaults
+	inFlight    int
+	waiting     int
+	next        time.Time // earliest start of the next request
+	requests    int64
+	lastRequest time.Time
+}
+
+func newHostLimiter(rps float64, maxInFlight int, custom bool) *hostLimiter {
+	return &hostLimiter{rps: rps, maxInFlight: maxInFlight, custom: custom, freed: make(chan struct{})}
+}
+
+// acquire waits for a free slot and then for the request's turn under the
+// rate limit. It gives up with the context's error when ctx is done first.
+func (l *hostLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	l.waiting++
+	for l.inFlight >= l.maxInFlight {
+		freed := l.freed
+		l.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.waiting--
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.waiting--
+	l.inFlight++
+	now := time.Now()
+	start := now
+	if l.next.After(now) {
+		start = l.next
+	}
+	l.next = start.Add(time.Duration(float64(time.Second) / l.rps))
+	l.requests++
+	l.lastRequest = start
+	l.mu.Unlock()
+
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			l.release()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (l *hostLimiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.wake()
+	l.mu.Unlock()
+}
+
+func (l *hostLimiter) setLimits(rps float64, maxInFlight int, custom bool) {
+	l.mu.Lock()
+	l.rps, l.maxInFlight, l.custom = rps, maxInFlight, custom
+	l.wake()
+	l.mu.Unlock()
+}
+
+// wake lets every waiter recheck for a free slot. l.mu must be held.
+func (l *hostLimiter) wake() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// Limits are keyed by the host a site_limits row was stored for, so a limit on
+// example.com is shared by img1.example.com and img2.example.com. Hosts
+// without a stored limit get their own limiter with the defaults.
+var (
+	hostLimitersMu sync.Mutex
+	hostLimiters   = make(map[string]*hostLimiter)
+	siteLimits     = make(map[string]SiteLimit)
+)
+
+// SiteLimit is a per-site override of the default limits.
+type SiteLimit struct {
+	Host        string  `json:"host"`
+	RPS         float64 `json:"rps"`
+	MaxInFlight int     `json:"maxInFlight"`
+}
+
+func loadSiteLimits() error {
+	rows, err := db.Query("SELECT host, rps, max_in_flight FROM site_limits")
+	if err != nil {
+		return fmt.Errorf("querying site limits: %v", err)
+	}
+	defer rows.Close()
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+	for rows.Next() {
+		var s SiteLimit
+		if err := rows.Scan(&s.Host, &s.RPS, &s.MaxInFlight); err != nil {
+			return fmt.Errorf("scanning site limit: %v", err)
+		}
+		siteLimits[s.Host] = s
+	}
+	return rows.Err()
+}
+
+// limiterFor returns the limiter that governs host.
+func limiterFor(host string) *hostLimiter {
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+	key := host
+	rps, maxInFlight, custom := defaultHostRPS, defaultHostMaxInFlight, false
+	for _, k := range hostAndParents(host) {
+		if s, ok := siteLimits[k]; ok {
+			key, rps, maxInFlight, custom = k, s.RPS, s.MaxInFlight, true
+			break
+		}
+	}
+	l, ok := hostLimiters[key]
+	if !ok {
+		l = newHostLimiter(rps, maxInFlight, custom)
+		hostLimiters[key] = l
+	}
+	return l
+}
+
+// limitedTransport applies site blocks, the per-host circuit breaker and
+// limits and the configured User-Agent to every request before handing it to
+// base.
+type limitedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", httpSettings.UserAgent)
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	if siteBlocked(host) {
+		return nil, fmt.Errorf("%w: %s", ErrSiteBlocked, host)
+	}
+	probe, err := breakerAllow(host)
+	if err != nil {
+		return nil, err
+	}
+	l := limiterFor(host)
+	if err := l.acquire(req.Context()); err != nil {
+		if probe {
+			breakerProbeAbandoned(host)
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		l.release()
+		breakerRecord(host, req.URL.String(), err.Error())
+		return nil, err
+	}
+	breakerRecord(host, req.URL.String(), responseFailure(resp))
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: l.release}
+	return resp, nil
+}
+
+// releasingBody frees the request's in-flight slot once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// HostUsage is the current state of one host limiter.
+type HostUsage struct {
+	Host          string  `json:"host"`
+	RPS           float64 `json:"rps"`
+	MaxInFlight   int     `json:"maxInFlight"`
+	Custom        bool    `json:"custom"`
+	InFlight      int     `json:"inFlight"`
+	Waiting       int     `json:"waiting"`
+	Requests      int64   `json:"requests"`
+	LastRequestAt string  `json:"lastRequestAt,omitempty"`
+}
+
+// listHostUsage shows every host contacted since startup plus any stored
+// limits, busiest first.
+func listHostUsage(c *gin.Context) {
+	hostLimitersMu.Lock()
+	usage := make([]HostUsage, 0, len(hostLimiters))
+	seen := make(map[string]bool)
+	for host, l := range hostLimiters {
+		l.mu.Lock()
+		u := HostUsage{Host: host, RPS: l.rps, MaxInFlight: l.maxInFlight, Custom: l.custom,
+			InFlight: l.inFlight, Waiting: l.waiting, Requests: l.requests}
+		if !l.lastRequest.IsZero() {
+			u.LastRequestAt = l.lastRequest.UTC().Format(time.RFC3339)
+		}
+		l.mu.Unlock()
+		usage = append(usage, u)
+		seen[host] = true
+	}
+	for host, s := range siteLimits {
+		if !seen[host] {
+			usage = append(usage, HostUsage{Host: host, RPS: s.RPS, MaxInFlight: s.MaxInFlight, Custom: true})
+		}
+	}
+	hostLimitersMu.Unlock()
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].InFlight+usage[i].Waiting != usage[j].InFlight+usage[j].Waiting {
+			return usage[i].InFlight+usage[i].Waiting > usage[j].InFlight+usage[j].Waiting
+		}
+		return usage[i].Requests > usage[j].Requests
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"defaults": gin.H{"rps": defaultHostRPS, "maxInFlight": defaultHostMaxInFlight},
+		"hosts":    usage,
+	})
+}
+
+func putSiteLimits(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	var req struct {
+		RPS         float64 `json:"rps" binding:"required,gt=0"`
+		MaxInFlight int     `json:"maxInFlight" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if _, err := execWithRetry("INSERT OR REPLACE INTO site_limits (host, rps, max_in_flight) VALUES (?, ?, ?)",
+		host, req.RPS, req.MaxInFlight); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s := SiteLimit{Host: host, RPS: req.RPS, MaxInFlight: req.MaxInFlight}
+	hostLimitersMu.Lock()
+	siteLimits[host] = s
+	l, ok := hostLimiters[host]
+	hostLimitersMu.Unlock()
+	if ok {
+		l.setLimits(s.RPS, s.MaxInFlight, true)
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func deleteSiteLimits(c *gin.Context) {
+	host := normalizeCookieDomain(c.Param("host"))
+	if _, err := execWithRetry("DELETE FROM site_limits WHERE host = ?", host); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	hostLimitersMu.Lock()
+	delete(siteLimits, host)
+	l, ok := hostLimiters[host]
+	hostLimitersMu.Unlock()
+	if ok {
+		l.setLimits(defaultHostRPS, defaultHostMaxInFlight, false)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Site limits removed"})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterAcquireHonoursContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		rps         float64
+		maxInFlight int
+		hold        bool // take the only slot first
+	}{
+		{name: "waiting for a slot", rps: 1000, maxInFlight: 1, hold: true},
+		{name: "waiting for the rate limit", rps: 0.01, maxInFlight: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newHostLimiter(tt.rps, tt.maxInFlight, false)
+			if err := l.acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.hold {
+				l.release()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("acquire = %v, want %v", err, context.DeadlineExceeded)
+			}
+			wantInFlight := 0
+			if tt.hold {
+				wantInFlight = 1
+			}
+			if l.inFlight != wantInFlight || l.waiting != 0 {
+				t.Errorf("inFlight = %d, waiting = %d, want %d and 0", l.inFlight, l.waiting, wantInFlight)
+			}
+		})
+	}
+}
+
+func TestHostLimiterReleaseWakesWaiter(t *testing.T) {
+	l := newHostLimiter(1000, 1, false)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- l.acquire(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not woken by release")
+	}
+}
@@ -2,26 +2,38 @@ package main
 
 import (
 	"fmt"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
 	"strings"
-	"time"
 
 	"github.com/gocolly/colly/v2"
 )
 
+// builtinRippers are the compiled-in rippers. Entries in the host rules file
+// with the same name take their place while the rule is loaded.
+var builtinRippers = map[string]Ripper{}
+
+func registerBuiltin(r Ripper) {
+	builtinRippers[r.Name()] = r
+	RegisterRipper(r, 0)
+}
+
+func init() {
+	registerBuiltin(&funcRipper{name: "imagebam", patterns: []string{"imagebam"}, rip: RipImageBam})
+	registerBuiltin(&funcRipper{name: "imgbox", patterns: []string{"imgbox"}, rip: RipImageBox})
+	registerBuiltin(&funcRipper{name: "imx.to", patterns: []string{"imx.to"}, useThumb: true, rip: RipImx})
+	registerBuiltin(&funcRipper{name: "turboimagehost", patterns: []string{"turboimagehost"}, rip: RipTurboImg})
+	registerBuiltin(&funcRipper{name: "vipr.im", patterns: []string{"vipr.im"}, useThumb: true, rip: RipViprIm})
+	registerBuiltin(&funcRipper{name: "pixhost", patterns: []string{"pixhost"}, useThumb: true, rip: RipPixHost})
+	registerBuiltin(&funcRipper{name: "acidimg", patterns: []string{"acidimg"}, useThumb: true, rip: RipAcidImg})
+	registerBuiltin(&funcRipper{name: "postimages", patterns: []string{"postimages.org"}, rip: RipPostImages})
+	registerBuiltin(&funcRipper{name: "pixxxels", patterns: []string{"pixxxels.cc"}, rip: RipPixxxels})
+	registerBuiltin(&funcRipper{name: "freeimage.us", patterns: []string{"freeimage.us"}, rip: RipFreeImage})
+}
+
 func RipImageBam(src string) (string, error) {
 	fmt.Printf("Starting RipImageBam for %s\n", src)
+	// Skips the adult-content interstitial.
+	setDefaultCookie("imagebam.com", "/", "nsfw_inter", "1")
 	c := newCollector()
-	cookieJar, _ := cookiejar.New(nil)
-	cookies := []*http.Cookie{
-		{Name: "nsfw_inter", Value: "1", Path: "/", Domain: "imagebam.com"},
-		{Name: "expires", Value: time.Now().AddDate(0, 0, 1).String(), Path: "/", Domain: "imagebam.com"},
-	}
-	targetURL, _ := url.Parse("https://imagebam.com")
-	cookieJar.SetCookies(targetURL, cookies)
-	c.SetCookieJar(cookieJar)
 
 	c.OnResponse(func(r *colly.Response) {
 		fmt.Printf("RipImageBam response for %s: Status %d\n", r.Request.URL.String(), r.StatusCode)
@@ -109,3 +121,47 @@ func RipTurboImg(src string) (string, error) {
 	}
 	return imageURL, nil
 }
+
+func RipPixxxels(src string) (string, error) {
+	fmt.Printf("Starting RipPixxxels for %s\n", src)
+	return ripFirstMatch("Pixxxels", src, "a#download", "href", "img#main-image", "src", "meta[property='og:image']", "content")
+}
+
+func RipFreeImage(src string) (string, error) {
+	fmt.Printf("Starting RipFreeImage for %s\n", src)
+	if strings.Contains(src, "/thumbs/") {
+		imageURL := strings.Replace(src, "/thumbs/", "/images/", 1)
+		fmt.Printf("Transformed FreeImage URL: %s\n", imageURL)
+		return imageURL, nil
+	}
+	return ripFirstMatch("FreeImage", src, "img#image", "src", "#image-viewer img", "src", "meta[property='og:image']", "content")
+}
+
+// ripFirstMatch visits src and returns the attribute of the first selector
+// that matches, trying selector/attribute pairs in order.
+func ripFirstMatch(host, src string, selectorAttrs ...string) (string, error) {
+	c := newCollector()
+	c.OnResponse(func(r *colly.Response) {
+		fmt.Printf("Rip%s response for %s: Status %d\n", host, r.Request.URL.String(), r.StatusCode)
+	})
+
+	found := make([]string, len(selectorAttrs)/2)
+	for i := 0; i+1 < len(selectorAttrs); i += 2 {
+		idx, attr := i/2, selectorAttrs[i+1]
+		c.OnHTML(selectorAttrs[i], func(e *colly.HTMLElement) {
+			if found[idx] == "" {
+				found[idx] = e.Request.AbsoluteURL(e.Attr(attr))
+			}
+		})
+	}
+	if err := c.Visit(src); err != nil {
+		return "", fmt.Errorf("visiting %s %s: %v", host, src, err)
+	}
+	for _, imageURL := range found {
+		if imageURL != "" {
+			fmt.Printf("Extracted %s URL: %s\n", host, imageURL)
+			return imageURL, nil
+		}
+	}
+	return "", fmt.Errorf("no image found on %s page %s", host, src)
+}
@@ -1,68 +1,112 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strings"
-	"time"
-
-	"github.com/gocolly/colly/v2"
 )
 
-func ListAllPosts(targetUrl string) ([]string, error) {
-	fmt.Printf("Starting ListAllPosts for %s\n", targetUrl)
-	targetUrl = strings.ReplaceAll(targetUrl, "[range]", "")
-	if strings.Contains(targetUrl, "#post") {
-		fmt.Printf("Single post detected: %s\n", targetUrl)
-		return []string{targetUrl}, nil
-	}
+// maxThreadPages caps thread enumeration, overridable with THREAD_MAX_PAGES.
+var maxThreadPages = envInt("THREAD_MAX_PAGES", 500)
 
-	if strings.Contains(targetUrl, "/page") {
-		targetUrl = strings.Split(targetUrl, "/page")[0]
-	}
-	targetUrl += "/page"
-	fmt.Printf("Base pagination URL: %s\n", targetUrl)
+// ThreadEnumerator walks the pages of a forum thread with the forum client
+// and streams each post as it is found, so callers never hold the whole
+// thread in memory.
+type ThreadEnumerator struct {
+	// StartPage is the first page to read (default 1).
+	StartPage int
+	// MaxPages caps how many pages are read (default maxThreadPages).
+	MaxPages int
+	// OnPost is called once per post, in page order. Returning an error
+	// stops the enumeration.
+	OnPost func(post ForumPost) error
+	// OnPage is called after every page with the number of new posts on it,
+	// the known last page (0 if unknown) and any fetch error for that page.
+	OnPage func(page, lastPage, posts int, err error)
+
+	// LastPage is the highest page actually read. A run stopped by MaxPages
+	// leaves it short of PageCount.
+	LastPage int
+	// PageCount is the thread's page count from the pagination control, or 0
+	// when the forum shows none.
+	PageCount int
+	// PageErrors counts pages that failed to load and were skipped.
+	PageErrors int
+}
 
-	postURLs := make(map[string]string)
-	page := 1
-	c := newCollector()
+// Run enumerates the thread that rawURL belongs to. A URL pointing at a
+// single post yields only that post.
+func (e *ThreadEnumerator) Run(rawURL string) error {
+	src := sourceFor(rawURL)
+	if src.PostIDFromURL(rawURL) != "" {
+		fmt.Printf("Single post detected: %s\n", rawURL)
+		return e.OnPost(ForumPost{ID: src.PostIDFromURL(rawURL), URL: rawURL})
+	}
 
-	c.OnHTML("[id^='post_message_']", func(e *colly.HTMLElement) {
-		postId := strings.ReplaceAll(e.Attr("id"), "post_message_", "")
-		currentPage := fmt.Sprintf("%s%d", targetUrl, page)
-		postURLs[postId] = currentPage + "#post" + postId
-		fmt.Printf("Found post ID %s on page %d\n", postId, page)
-	})
+	threadURL := src.ThreadURL(rawURL)
+	start := e.StartPage
+	if start < 1 {
+		start = 1
+	}
+	maxPages := e.MaxPages
+	if maxPages <= 0 {
+		maxPages = maxThreadPages
+	}
+	fmt.Printf("Enumerating %s thread %s from page %d (max %d pages)\n", src.Name(), threadURL, start, maxPages)
 
-	for {
-		currentPage := fmt.Sprintf("%s%d", targetUrl, page)
-		fmt.Printf("Visiting page %d: %s\n", page, currentPage)
-		if err := c.Visit(currentPage); err != nil {
-			fmt.Printf("Error visiting %s: %v\n", currentPage, err)
+	seen := make(map[string]bool)
+	lastPage := 0
+	for page := start; page < start+maxPages; page++ {
+		if lastPage > 0 && page > lastPage {
 			break
 		}
-		if len(postURLs) == 0 {
-			fmt.Printf("No posts found on page %d, stopping\n", page)
-			break
+		pageURL := src.PageURL(threadURL, page)
+		doc, err := fetchForumDocument(pageURL)
+		if err != nil {
+			// Without a known page count we cannot tell a bad page from the
+			// end of the thread, so only skip pages when the count is known.
+			// A blocked site fails every remaining page, so stop there too.
+			if page == start || lastPage == 0 || errors.Is(err, ErrSiteBlocked) {
+				e.report(page, lastPage, 0, err)
+				return err
+			}
+			fmt.Printf("Skipping page %d of %s: %v\n", page, threadURL, err)
+			e.PageErrors++
+			e.report(page, lastPage, 0, err)
+			continue
 		}
-		time.Sleep(1 * time.Second)
-		prevCount := len(postURLs)
-		page++
-		fmt.Printf("Checking next page %d\n", page)
-		if err := c.Visit(fmt.Sprintf("%s%d", targetUrl, page)); err != nil {
-			fmt.Printf("Error on page %d: %v, stopping\n", page, err)
-			break
+		if n := src.LastPage(doc); n > lastPage {
+			lastPage = n
+		}
+
+		newPosts := 0
+		for _, post := range src.Posts(doc, pageURL) {
+			if seen[post.ID] {
+				continue
+			}
+			seen[post.ID] = true
+			newPosts++
+			if err := e.OnPost(post); err != nil {
+				return err
+			}
 		}
-		if len(postURLs) == prevCount {
-			fmt.Printf("No new posts on page %d, stopping\n", page)
+		// A repeated page (no new posts, no pagination) was not really read.
+		if (newPosts > 0 || lastPage > 0) && page > e.LastPage {
+			e.LastPage = page
+		}
+		e.PageCount = lastPage
+		e.report(page, lastPage, newPosts, nil)
+
+		// Forums without pagination controls repeat the last page for
+		// out-of-range page numbers; no new posts means we are done.
+		if lastPage == 0 && newPosts == 0 {
 			break
 		}
 	}
+	return nil
+}
 
-	var urls []string
-	for postId, url := range postURLs {
-		fmt.Printf("Collected post %s: %s\n", postId, url)
-		urls = append(urls, url)
+func (e *ThreadEnumerator) report(page, lastPage, posts int, err error) {
+	if e.OnPage != nil {
+		e.OnPage(page, lastPage, posts, err)
 	}
-	fmt.Printf("Total posts collected: %d\n", len(urls))
-	return urls, nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Segmented downloads: files of at least SEGMENTED_DOWNLOAD_THRESHOLD_MB from
+// servers that advertise Accept-Ranges are fetched as SEGMENTED_DOWNLOAD_SEGMENTS
+// concurrent byte ranges. One segment disables it.
+var (
+	segmentThreshold = int64(envInt("SEGMENTED_DOWNLOAD_THRESHOLD_MB", 8)) << 20
+	segmentCount     = envInt("SEGMENTED_DOWNLOAD_SEGMENTS", 4)
+)
+
+// errRangeIgnored is returned when a range request is answered with the
+// whole file, because the server ignores Range after all or because the file
+// no longer matches If-Range. Either way it has to be fetched in one piece.
+var errRangeIgnored = errors.New("server ignored the Range header")
+
+// minSegmentSize keeps segments from getting so small that the extra
+// requests cost more than they gain.
+const minSegmentSize = 1 << 20
+
+// segmentsFor returns how many segments to split a fresh 200 response into,
+// or 1 to download it in one piece.
+func segmentsFor(resp *http.Response) int {
+	if segmentCount < 2 || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength < segmentThreshold {
+		return 1
+	}
+	return int(min(int64(segmentCount), resp.ContentLength/minSegmentSize))
+}
+
+// downloadSegmented fetches the body of resp in segments. resp, a plain GET,
+// supplies the first segment; the others are requested with Range headers
+// at the same time. The segments are written into a separate temp file, not
+// the .part file, since a half-filled file of full length cannot be resumed.
+// Range requests carry If-Range with resp's validator and must report the
+// same total length, so a file that changes mid-download is not stitched
+// together from two versions.
+func downloadSegmented(url, path string, resp *http.Response, segments int) (string, error) {
+	total := resp.ContentLength
+	segPath := path + ".seg" + partSuffix
+	out, err := os.OpenFile(segPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", fmt.Errorf("creating file %s: %v", segPath, err)
+	}
+	if err := out.Truncate(total); err != nil {
+		out.Close()
+		os.Remove(segPath)
+		return "", fmt.Errorf("sizing %s: %v", segPath, err)
+	}
+	fmt.Printf("Downloading %s (%d bytes) in %d segments\n", url, total, segments)
+	validator := rangeValidator(resp)
+
+	size := total / int64(segments)
+	errs := make([]error, segments)
+	var wg sync.WaitGroup
+	for i := 0; i < segments; i++ {
+		start := int64(i) * size
+		end := start + size - 1
+		if i == segments-1 {
+			end = total - 1
+		}
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = copySegment(out, resp.Body, start, end)
+				// The rest of the body belongs to the other segments.
+				resp.Body.Close()
+				return
+			}
+			errs[i] = fetchSegment(url, validator, out, start, end, total)
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	if closeErr := out.Close(); closeErr != nil {
+		errs = append(errs, closeErr)
+	}
+	for _, err := range errs {
+		if err != nil {
+			os.Remove(segPath)
+			return "", fmt.Errorf("segmented download of %s: %w", url, err)
+		}
+	}
+	// Every segment wrote exactly its bytes, so the file is complete.
+	return finishDownload(segPath, path, resp.Header.Get("Content-Type"))
+}
+
+// rangeValidator returns the strong ETag of resp, or else its Last-Modified
+// date, for If-Range. Weak ETags are not allowed there.
+func rangeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// fetchSegment requests bytes start-end of url and writes them at start. A
+// 200 answer is errRangeIgnored; a server whose file changed size reports
+// another total, which is an error too.
+func fetchSegment(url, validator string, out *os.File, start, end, total int64) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching bytes %d-%d: %w", start, end, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("bytes %d-%d: %w", start, end, errRangeIgnored)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status %s for bytes %d-%d", resp.Status, start, end)
+	}
+	if got, size, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || got != start || size != total {
+		return fmt.Errorf("unexpected Content-Range %q for bytes %d-%d", resp.Header.Get("Content-Range"), start, end)
+	}
+	return copySegment(out, resp.Body, start, end)
+}
+
+// copySegment writes exactly the bytes start-end from body into out.
+func copySegment(out *os.File, body io.Reader, start, end int64) error {
+	want := end - start + 1
+	n, err := io.CopyN(io.NewOffsetWriter(out, start), body, want)
+	if err != nil {
+		return fmt.Errorf("bytes %d-%d: got %d of %d: %v", start, end, n, want, err)
+	}
+	return nil
+}
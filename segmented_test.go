@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSegmentsFor(t *testing.T) {
+	threshold, count := segmentThreshold, segmentCount
+	t.Cleanup(func() { segmentThreshold, segmentCount = threshold, count })
+
+	const mb = 1 << 20
+	tests := []struct {
+		name          string
+		threshold     int64
+		count         int
+		acceptRanges  string
+		contentLength int64
+		want          int
+	}{
+		{"large file", 8 * mb, 4, "bytes", 100 * mb, 4},
+		{"exactly the threshold", 8 * mb, 4, "bytes", 8 * mb, 4},
+		{"below the threshold", 8 * mb, 4, "bytes", 8*mb - 1, 1},
+		{"no range support", 8 * mb, 4, "", 100 * mb, 1},
+		{"ranges refused", 8 * mb, 4, "none", 100 * mb, 1},
+		{"unknown length", 8 * mb, 4, "bytes", -1, 1},
+		{"segmenting disabled", 8 * mb, 1, "bytes", 100 * mb, 1},
+		{"segments of at least a megabyte", 1 * mb, 8, "bytes", 3*mb + 1, 3},
+	}
+	for _, tt := range tests {
+		segmentThreshold, segmentCount = tt.threshold, tt.count
+		resp := &http.Response{Header: http.Header{}, ContentLength: tt.contentLength}
+		if tt.acceptRanges != "" {
+			resp.Header.Set("Accept-Ranges", tt.acceptRanges)
+		}
+		if got := segmentsFor(resp); got != tt.want {
+			t.Errorf("%s: segmentsFor = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRangeValidator(t *testing.T) {
+	tests := []struct {
+		etag, lastModified string
+		want               string
+	}{
+		{`"abc"`, "Wed, 01 Jan 2025 00:00:00 GMT", `"abc"`},
+		{`W/"abc"`, "Wed, 01 Jan 2025 00:00:00 GMT", "Wed, 01 Jan 2025 00:00:00 GMT"},
+		{`W/"abc"`, "", ""},
+		{"", "Wed, 01 Jan 2025 00:00:00 GMT", "Wed, 01 Jan 2025 00:00:00 GMT"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.etag != "" {
+			resp.Header.Set("ETag", tt.etag)
+		}
+		if tt.lastModified != "" {
+			resp.Header.Set("Last-Modified", tt.lastModified)
+		}
+		if got := rangeValidator(resp); got != tt.want {
+			t.Errorf("rangeValidator(ETag %q, Last-Modified %q) = %q, want %q", tt.etag, tt.lastModified, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadSegmented(t *testing.T) {
+	threshold, count := segmentThreshold, segmentCount
+	t.Cleanup(func() { segmentThreshold, segmentCount = threshold, count })
+	segmentThreshold, segmentCount = 2*minSegmentSize, 4
+
+	// Lift the default per-host limit so the test server is not throttled.
+	hostLimitersMu.Lock()
+	siteLimits["127.0.0.1"] = SiteLimit{Host: "127.0.0.1", RPS: 1000, MaxInFlight: 16}
+	delete(hostLimiters, "127.0.0.1")
+	hostLimitersMu.Unlock()
+	t.Cleanup(func() {
+		hostLimitersMu.Lock()
+		delete(siteLimits, "127.0.0.1")
+		delete(hostLimiters, "127.0.0.1")
+		hostLimitersMu.Unlock()
+	})
+
+	data := testPNG(t, 1024, 1024) // about 4 MB of noise
+	if int64(len(data)) < segmentThreshold {
+		t.Fatalf("test image is only %d bytes", len(data))
+	}
+	tests := []struct {
+		name   string
+		ignore bool // advertise ranges but always send the whole file
+	}{
+		{name: "server honours ranges"},
+		{name: "server ignores ranges", ignore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ranges, plain := 0, 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				if r.Header.Get("Range") != "" {
+					ranges++
+				} else {
+					plain++
+				}
+				mu.Unlock()
+				if tt.ignore {
+					w.Header().Set("Accept-Ranges", "bytes")
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.Write(data)
+					return
+				}
+				http.ServeContent(w, r, "image.png", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+			dir := t.TempDir()
+			path := filepath.Join(dir, "image.png")
+
+			if _, err := DownloadFile(srv.URL+"/image.png", path); err != nil {
+				t.Fatalf("DownloadFile: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded file differs: got %d bytes, want %d", len(got), len(data))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ranges < segmentCount-1 {
+				t.Errorf("%d range requests, want at least %d", ranges, segmentCount-1)
+			}
+			if wantPlain := map[bool]int{false: 1, true: 2}[tt.ignore]; plain != wantPlain {
+				t.Errorf("%d whole-file requests, want %d", plain, wantPlain)
+			}
+			leftovers, _ := filepath.Glob(filepath.Join(dir, "*"+partSuffix))
+			if len(leftovers) > 0 {
+				t.Errorf("temporary files left behind: %v", leftovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrSiteBlocked is returned (wrapped) for any request to a site, or a
+// subdomain of it, while the site is serving an anti-bot challenge. Requests that hit it go back to pending.
+var ErrSiteBlocked = errors.New("site is blocked by an anti-bot challenge")
+
+// SiteBlock records a site that answered with a challenge page. All work for
+// the site is paused until it is resumed, normally after importing fresh
+// cookies from a browser that passed the challenge.
+type SiteBlock struct {
+	Host      string `json:"host"`
+	Reason    string `json:"reason"`
+	BlockedAt string `json:"blockedAt"`
+}
+
+var (
+	siteBlocksMu sync.RWMutex
+	siteBlocks   = make(map[string]SiteBlock)
+)
+
+// challengeMarkers identify interstitial pages served instead of content.
+var challengeMarkers = []struct {
+	marker string
+	reason string
+}{
+	{"DDoS-Guard", "DDoS-Guard challenge"},
+	{"Checking your browser", "browser check"},
+	{"cf-chl-", "Cloudflare challenge"},
+	{"<title>Just a moment...</title>", "Cloudflare challenge"},
+	{"Attention Required! | Cloudflare", "Cloudflare block"},
+}
+
+// detectChallenge returns why a response looks like an anti-bot challenge, or
+// "" for a normal page.
+func detectChallenge(body []byte) string {
+	for _, m := range challengeMarkers {
+		if bytes.Contains(body, []byte(m.marker)) {
+			return m.reason
+		}
+	}
+	return ""
+}
+
+func loadSiteBlocks() error {
+	rows, err := db.Query("SELECT host, reason, blocked_at FROM site_blocks")
+	if err != nil {
+		return fmt.Errorf("querying site blocks: %v", err)
+	}
+	defer rows.Close()
+	siteBlocksMu.Lock()
+	defer siteBlocksMu.Unlock()
+	for rows.Next() {
+		var b SiteBlock
+		if err := rows.Scan(&b.Host, &b.Reason, &b.BlockedAt); err != nil {
+			return fmt.Errorf("scanning site block: %v", err)
+		}
+		b.Host = siteBlockKey(b.Host)
+		siteBlocks[b.Host] = b
+		log.Printf("Site %s is blocked (%s) since %s; resume it once cookies are refreshed", b.Host, b.Reason, b.BlockedAt)
+	}
+	return rows.Err()
+}
+
+// siteBlockKey folds www.example.com into example.com: a challenge served on
+// either covers both.
+func siteBlockKey(host string) string {
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}
+
+// siteBlocked reports whether host or a parent domain of it is blocked.
+func siteBlocked(host string) bool {
+	siteBlocksMu.RLock()
+	defer siteBlocksMu.RUnlock()
+	for _, key := range hostAndParents(siteBlockKey(host)) {
+		if _, ok := siteBlocks[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func blockedHosts() []string {
+	siteBlocksMu.RLock()
+	defer siteBlocksMu.RUnlock()
+	hosts := make([]string, 0, len(siteBlocks))
+	for host := range siteBlocks {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// blockSite pauses a site and tells websocket clients. Blocking an already
+// blocked site is a no-op.
+func blockSite(host, reason string) {
+	host = siteBlockKey(host)
+	siteBlocksMu.Lock()
+	if _, ok := siteBlocks[host]; ok {
+		siteBlocksMu.Unlock()
+		return
+	}
+	siteBlocks[host] = SiteBlock{Host: host, Reason: reason}
+	siteBlocksMu.Unlock()
+
+	if _, err := execWithRetry("INSERT OR REPLACE INTO site_blocks (host, reason) VALUES (?, ?)", host, reason); err != nil {
+		log.Printf("Failed to persist block of %s: %v", host, err)
+	}
+	var blockedAt string
+	if err := db.QueryRow("SELECT blocked_at FROM site_blocks WHERE host = ?", host).Scan(&blockedAt); err == nil {
+		siteBlocksMu.Lock()
+		siteBlocks[host] = SiteBlock{Host: host, Reason: reason, BlockedAt: blockedAt}
+		siteBlocksMu.Unlock()
+	}
+	log.Printf("Pausing all work for %s: %s", host, reason)
+	broadcastEvent("site_blocked", gin.H{"host": host, "reason": reason})
+}
+
+func resumeSite(host string) bool {
+	host = siteBlockKey(host)
+	siteBlocksMu.Lock()
+	_, ok := siteBlocks[host]
+	delete(siteBlocks, host)
+	siteBlocksMu.Unlock()
+	if !ok {
+		return false
+	}
+	if _, err := execWithRetry("DELETE FROM site_blocks WHERE host = ? OR host = ?", host, "www."+host); err != nil {
+		log.Printf("Failed to delete block of %s: %v", host, err)
+	}
+	resetBreaker(host)
+	log.Printf("Resuming work for %s", host)
+	broadcastEvent("site_resumed", gin.H{"host": host})
+	return true
+}
+
+// urlOnHostClause returns a condition and its arguments matching a
+// requests.url on host or any subdomain of it.
+func urlOnHostClause(host string) (string, []interface{}) {
+	return "(instr(url, ?) > 0 OR instr(url, ?) > 0 OR instr(url, ?) > 0 OR instr(url, ?) > 0)",
+		[]interface{}{"://" + host + "/", "://" + host + ":", "." + host + "/", "." + host + ":"}
+}
+
+// blockedHostFilter returns a WHERE fragment and its arguments that exclude
+// requests for blocked sites and their subdomains from a query over
+// requests.url.
+func blockedHostFilter() (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for _, host := range blockedHosts() {
+		clause, hostArgs := urlOnHostClause(host)
+		clauses = append(clauses, "NOT "+clause)
+		args = append(args, hostArgs...)
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+func listSiteBlocks(c *gin.Context) {
+	siteBlocksMu.RLock()
+	blocks := make([]SiteBlock, 0, len(siteBlocks))
+	for _, b := range siteBlocks {
+		blocks = append(blocks, b)
+	}
+	siteBlocksMu.RUnlock()
+	c.JSON(http.StatusOK, blocks)
+}
+
+func resumeSiteHandler(c *gin.Context) {
+	host := siteBlockKey(c.Param("host"))
+	if !resumeSite(host) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Site is not blocked"})
+		return
+	}
+	var pending int
+	clause, args := urlOnHostClause(host)
+	if err := db.QueryRow("SELECT COUNT(*) FROM requests WHERE status = 'pending' AND "+clause, args...).Scan(&pending); err != nil {
+		log.Printf("Error counting pending requests for %s: %v", host, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Site resumed", "pending": pending})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ForumPost is a single post located on a parsed thread page.
+type ForumPost struct {
+	ID   string             // element id used for the post folder, e.g. post_message_123
+	URL  string             // permalink queued as a request
+	Body *goquery.Selection // the post content
+}
+
+// Source knows the markup and URL conventions of one forum engine.
+type Source interface {
+	Name() string
+	// Match reports whether a thread or post URL belongs to this engine.
+	Match(rawURL string) bool
+	// ThreadURL strips paging and post anchors, leaving the thread root.
+	ThreadURL(rawURL string) string
+	// PageURL returns page n (1-based) of the thread.
+	PageURL(threadURL string, page int) string
+	// LastPage reads the thread's page count from the pagination control,
+	// returning 0 when the page has no pagination.
+	LastPage(doc *goquery.Document) int
+	// PostIDFromURL returns the post referenced by the URL, or "".
+	PostIDFromURL(rawURL string) string
+	// Posts lists every post on a thread page.
+	Posts(doc *goquery.Document, pageURL string) []ForumPost
+	// FindPost returns the post with the given id from a thread page.
+	FindPost(doc *goquery.Document, postID string) (ForumPost, bool)
+	// PostLinks extracts the image links from a post.
+	PostLinks(post ForumPost) []PostLink
+	// PostMeta reads the thread title and the post's author, date and text.
+	PostMeta(doc *goquery.Document, post ForumPost) PostMeta
+}
+
+// sources are tried in order; vBulletin matches anything and stays last.
+var sources = []Source{xenForoSource{}, vBulletinSource{}}
+
+func sourceFor(rawURL string) Source {
+	for _, s := range sources {
+		if s.Match(rawURL) {
+			return s
+		}
+	}
+	return vBulletinSource{}
+}
+
+var pageOfRe = regexp.MustCompile(`(?i)page\s+\d+\s+of\s+(\d+)`)
+
+// maxPageNumber returns the largest page number among the links matched by
+// sel, reading it from the link href with hrefRe or from the link text.
+func maxPageNumber(doc *goquery.Document, sel string, hrefRe *regexp.Regexp) int {
+	last := 0
+	doc.Find(sel).Each(func(_ int, a *goquery.Selection) {
+		n := 0
+		if m := hrefRe.FindStringSubmatch(a.AttrOr("href", "")); m != nil {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(a.Text())); err == nil && v > n {
+			n = v
+		}
+		if n > last {
+			last = n
+		}
+	})
+	return last
+}
+
+func stripFragment(rawURL string) string {
+	if idx := strings.Index(rawURL, "#"); idx != -1 {
+		return rawURL[:idx]
+	}
+	return rawURL
+}
+
+// vBulletinSource handles vBulletin 3/4 threads: /pageN paging, #postN
+// anchors and post_message_N content divs.
+type vBulletinSource struct{}
+
+func (vBulletinSource) Name() string { return "vbulletin" }
+
+func (vBulletinSource) Match(string) bool { return true }
+
+func (vBulletinSource) ThreadURL(rawURL string) string {
+	threadURL := rawURL
+	if idx := strings.Index(threadURL, "/page"); idx != -1 {
+		threadURL = threadURL[:idx]
+	}
+	return stripFragment(threadURL)
+}
+
+func (vBulletinSource) PageURL(threadURL string, page int) string {
+	if page <= 1 {
+		return threadURL
+	}
+	if strings.Contains(threadURL, "?") {
+		return fmt.Sprintf("%s&page=%d", threadURL, page)
+	}
+	return fmt.Sprintf("%s/page%d", strings.TrimRight(threadURL, "/"), page)
+}
+
+var vBulletinPageHrefRe = regexp.MustCompile(`(?:/page|[?&]page=)(\d+)`)
+
+func (vBulletinSource) LastPage(doc *goquery.Document) int {
+	// vB3 prints "Page 1 of 12" in the pagenav control; vB4 has the same text
+	// in the pagination popup. Fall back to the highest linked page.
+	last := 0
+	doc.Find(".pagenav .vbmenu_control, .pagination .popupctrl, .pagenav, .pagination").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		if m := pageOfRe.FindStringSubmatch(s.Text()); m != nil {
+			last, _ = strconv.Atoi(m[1])
+			return false
+		}
+		return true
+	})
+	if last > 0 {
+		return last
+	}
+	return maxPageNumber(doc, ".pagenav a, .pagination a", vBulletinPageHrefRe)
+}
+
+func (vBulletinSource) PostIDFromURL(rawURL string) string {
+	if !strings.Contains(rawURL, "#post") {
+		return ""
+	}
+	split := strings.Split(rawURL, "#post")
+	return "post" + split[len(split)-1]
+}
+
+func (vBulletinSource) Posts(doc *goquery.Document, pageURL string) []ForumPost {
+	var posts []ForumPost
+	doc.Find("div[id^='post_message_']").Each(func(_ int, s *goquery.Selection) {
+		id, exists := s.Attr("id")
+		if !exists {
+			return
+		}
+		posts = append(posts, ForumPost{ID: id, URL: stripFragment(pageURL) + "#" + id, Body: s})
+	})
+	return posts
+}
+
+func (vBulletinSource) FindPost(doc *goquery.Document, postID string) (ForumPost, bool) {
+	s := doc.Find(fmt.Sprintf("div[id^='%s']", postID)).First()
+	if s.Length() == 0 {
+		return ForumPost{}, false
+	}
+	id := s.AttrOr("id", postID)
+	return ForumPost{ID: id, Body: s}, true
+}
+
+func (vBulletinSource) PostLinks(post ForumPost) []PostLink {
+	var links []PostLink
+	post.Body.Find("a img").Each(func(i int, img *goquery.Selection) {
+		if img.AttrOr("alt", "") == "View Post" {
+			fmt.Printf("Skipping element %d: alt='View Post'\n", i)
+			return
+		}
+		src, exists := img.Parent().Attr("href")
+		if !exists {
+			fmt.Printf("Element %d: No href found\n", i)
+			return
+		}
+		links = append(links, PostLink{Href: src, Thumb: img.AttrOr("src", "")})
+	})
+	return links
+}
+
+// threadTitleFromPage falls back to the page title, minus the " - Site Name"
+// suffix forums append.
+func threadTitleFromPage(doc *goquery.Document) string {
+	title := cleanText(doc.Find("title").First().Text())
+	if idx := strings.LastIndex(title, " - "); idx > 0 {
+		title = title[:idx]
+	}
+	return title
+}
+
+func (vBulletinSource) PostMeta(doc *goquery.Document, post ForumPost) PostMeta {
+	meta := PostMeta{Text: cleanText(post.Body.Text())}
+	// vB4 puts the title in .threadtitle; vB3 only has it in the navbar and
+	// the page title.
+	meta.ThreadTitle = cleanText(doc.Find("span.threadtitle, h1 .threadtitle, #pagetitle .threadtitle").First().Text())
+	if meta.ThreadTitle == "" {
+		meta.ThreadTitle = threadTitleFromPage(doc)
+	}
+
+	// The post container is li#post_N on vB4 and table#postN on vB3.
+	container := post.Body.Parent().Closest("li[id^='post_'], table[id^='post']")
+	if container.Length() == 0 {
+		return meta
+	}
+	meta.Author = cleanText(container.Find(".username, a.bigusername").First().Text())
+	dateText := container.Find("span.date, .postdate").First().Text()
+	if dateText == "" {
+		dateText = container.Find("td.thead").First().Text()
+	}
+	if t, ok := parsePostDate(dateText, time.Now()); ok {
+		meta.PostedAt = t
+	}
+	return meta
+}
+
+var vBulletinInvalidLoginRe = regexp.MustCompile(`(?i)invalid username or password|wrong password`)
+
+// vBulletinSessionCookie reports whether name is one of the <prefix>userid,
+// <prefix>password or <prefix>sessionhash cookies holding a vBulletin session.
+func vBulletinSessionCookie(name string) bool {
+	return strings.HasSuffix(name, "userid") || strings.HasSuffix(name, "password") || strings.HasSuffix(name, "sessionhash")
+}
+
+// LoggedOut reports whether the navbar login form is shown, which vBulletin
+// only renders for guests.
+func (vBulletinSource) LoggedOut(body []byte) bool {
+	return bytes.Contains(body, []byte(`name="vb_login_username"`)) && !bytes.Contains(body, []byte("do=logout"))
+}
+
+// Login posts the navbar login form. vBulletin 3 and 4 both accept the MD5 of
+// the password in place of the password itself; with cookieuser=1 the session
+// is kept in long-lived <prefix>userid/<prefix>password cookies. The expired
+// session is cleared first, so only cookies set by this login count.
+func (vBulletinSource) Login(pageURL string, cred SiteCredential) error {
+	loginURL := cred.LoginURL
+	if loginURL == "" {
+		u, err := url.Parse(pageURL)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", pageURL, err)
+		}
+		loginURL = u.Scheme + "://" + u.Host + "/login.php?do=login"
+	}
+	siteCookies.removeMatching(hostOf(pageURL), vBulletinSessionCookie)
+	if host := hostOf(loginURL); host != hostOf(pageURL) {
+		siteCookies.removeMatching(host, vBulletinSessionCookie)
+	}
+	sum := md5.Sum([]byte(cred.Password))
+	passwordHash := hex.EncodeToString(sum[:])
+	form := url.Values{
+		"do":                       {"login"},
+		"vb_login_username":        {cred.Username},
+		"vb_login_password":        {""},
+		"vb_login_md5password":     {passwordHash},
+		"vb_login_md5password_utf": {passwordHash},
+		"cookieuser":               {"1"},
+		"securitytoken":            {"guest"},
+		"s":                        {""},
+	}
+	req, err := http.NewRequest("POST", loginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating login request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := forumClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting login form: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading login response: %v", err)
+	}
+
+	if vBulletinInvalidLoginRe.Match(body) {
+		return fmt.Errorf("invalid username or password")
+	}
+	for _, c := range siteCookies.Cookies(resp.Request.URL) {
+		if strings.HasSuffix(c.Name, "userid") && c.Value != "" && c.Value != "0" {
+			return nil
+		}
+	}
+	if bytes.Contains(body, []byte("Thank you for logging in")) {
+		return nil
+	}
+	return fmt.Errorf("login was not accepted (status %d)", resp.StatusCode)
+}
+
+// resolveHref makes href absolute against the page it was found on. It is
+// returned unchanged when either cannot be parsed.
+func resolveHref(pageURL, href string) string {
+	if href == "" || pageURL == "" {
+		return href
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return href
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// xenForoSource handles XenForo 2 threads: /threads/slug.123/page-N paging,
+// #post-N anchors and article.message posts.
+type xenForoSource struct{}
+
+var (
+	xenForoThreadRe = regexp.MustCompile(`/threads/[^/#?]*\.\d+(/|$|#|\?)`)
+	xenForoPageRe   = regexp.MustCompile(`/page-\d+/?$`)
+)
+
+func (xenForoSource) Name() string { return "xenforo" }
+
+func (xenForoSource) Match(rawURL string) bool {
+	return xenForoThreadRe.MatchString(rawURL) || strings.Contains(rawURL, "/posts/")
+}
+
+func (xenForoSource) ThreadURL(rawURL string) string {
+	threadURL := stripFragment(rawURL)
+	if idx := strings.Index(threadURL, "?"); idx != -1 {
+		threadURL = threadURL[:idx]
+	}
+	threadURL = xenForoPageRe.ReplaceAllString(threadURL, "")
+	return strings.TrimRight(threadURL, "/")
+}
+
+func (xenForoSource) PageURL(threadURL string, page int) string {
+	if page <= 1 {
+		return threadURL + "/"
+	}
+	return fmt.Sprintf("%s/page-%d", strings.TrimRight(threadURL, "/"), page)
+}
+
+var xenForoPageHrefRe = regexp.MustCompile(`/page-(\d+)`)
+
+func (xenForoSource) LastPage(doc *goquery.Document) int {
+	return maxPageNumber(doc, ".pageNav-main a, .pageNavSimple a", xenForoPageHrefRe)
+}
+
+var xenForoPostPathRe = regexp.MustCompile(`/posts/(\d+)`)
+
+// PostIDFromURL understands both thread links with a #post-N anchor and
+// /posts/N/ permalinks, which redirect to the thread page holding the post.
+func (xenForoSource) PostIDFromURL(rawURL string) string {
+	if idx := strings.LastIndex(rawURL, "#post-"); idx != -1 {
+		return "post-" + rawURL[idx+len("#post-"):]
+	}
+	if m := xenForoPostPathRe.FindStringSubmatch(rawURL); m != nil {
+		return "post-" + m[1]
+	}
+	return ""
+}
+
+func (xenForoSource) Posts(doc *goquery.Document, pageURL string) []ForumPost {
+	var posts []ForumPost
+	doc.Find("article.message[data-content^='post-']").Each(func(_ int, s *goquery.Selection) {
+		id := s.AttrOr("data-content", "")
+		posts = append(posts, ForumPost{ID: id, URL: stripFragment(pageURL) + "#" + id, Body: s.Find(".message-body .bbWrapper").First()})
+	})
+	return posts
+}
+
+func (xenForoSource) FindPost(doc *goquery.Document, postID string) (ForumPost, bool) {
+	s := doc.Find(fmt.Sprintf("article.message[data-content='%s']", postID)).First()
+	if s.Length() == 0 {
+		return ForumPost{}, false
+	}
+	return ForumPost{ID: postID, Body: s.Find(".message-body .bbWrapper").First()}, true
+}
+
+func (xenForoSource) PostMeta(doc *goquery.Document, post ForumPost) PostMeta {
+	meta := PostMeta{Text: cleanText(post.Body.Text())}
+	meta.ThreadTitle = cleanText(doc.Find("h1.p-title-value").First().Text())
+	if meta.ThreadTitle == "" {
+		meta.ThreadTitle = threadTitleFromPage(doc)
+	}
+	article := post.Body.Closest("article.message")
+	meta.Author = article.AttrOr("data-author", "")
+	if meta.Author == "" {
+		meta.Author = cleanText(article.Find(".message-name").First().Text())
+	}
+	// XenForo dates carry an ISO 8601 timestamp with the zone.
+	if dt, ok := article.Find(".message-attribution time[datetime], time.u-dt").First().Attr("datetime"); ok {
+		if t, err := time.Parse("2006-01-02T15:04:05-0700", dt); err == nil {
+			meta.PostedAt = t
+		} else if t, err := time.Parse(time.RFC3339, dt); err == nil {
+			meta.PostedAt = t
+		}
+	}
+	return meta
+}
+
+func (xenForoSource) PostLinks(post ForumPost) []PostLink {
+	var links []PostLink
+	post.Body.Find("img").Each(func(_ int, img *goquery.Selection) {
+		if img.HasClass("smilie") {
+			return
+		}
+		// Attachments are linked relative to the forum.
+		thumb := resolveHref(post.URL, img.AttrOr("data-src", img.AttrOr("src", "")))
+		if a := img.Closest("a"); a.Length() > 0 {
+			if href, ok := a.Attr("href"); ok {
+				links = append(links, PostLink{Href: resolveHref(post.URL, href), Thumb: thumb})
+				return
+			}
+		}
+		// Images embedded directly with [IMG] have no link; the image itself
+		// is the target.
+		if img.HasClass("bbImage") && thumb != "" {
+			links = append(links, PostLink{Href: resolveHref(post.URL, img.AttrOr("data-url", thumb)), Thumb: thumb})
+		}
+	})
+	return links
+}
@@ -80,8 +80,7 @@ func searchStashDBPeople(c *gin.Context) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("ApiKey", apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := newHTTPClient(httpSettings.Timeout).Do(req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query StashDB: " + err.Error()})
 		return
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Studio is a producer galleries can be attributed to. Aliases cover other
+// spellings and the site names that show up in titles and URLs.
+type Studio struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	Aliases      []string `json:"aliases"`
+	GalleryCount int      `json:"galleryCount,omitempty"`
+}
+
+// StudioSummary is the studio as embedded in gallery listings.
+type StudioSummary struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func parseAliases(aliasesJSON sql.NullString) []string {
+	aliases := []string{}
+	if aliasesJSON.Valid && aliasesJSON.String != "" {
+		if err := json.Unmarshal([]byte(aliasesJSON.String), &aliases); err != nil {
+			log.Printf("Failed to unmarshal aliases '%s': %v", aliasesJSON.String, err)
+			return []string{}
+		}
+	}
+	return aliases
+}
+
+func loadStudios() ([]Studio, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.name, s.aliases, COUNT(g.id)
+		FROM studios s
+		LEFT JOIN galleries g ON g.studio_id = s.id
+		GROUP BY s.id
+		ORDER BY s.name`)
+	if err != nil {
+		return nil, fmt.Errorf("querying studios: %v", err)
+	}
+	defer rows.Close()
+	studios := []Studio{}
+	for rows.Next() {
+		var s Studio
+		var aliasesJSON sql.NullString
+		if err := rows.Scan(&s.ID, &s.Name, &aliasesJSON, &s.GalleryCount); err != nil {
+			return nil, fmt.Errorf("scanning studio: %v", err)
+		}
+		s.Aliases = parseAliases(aliasesJSON)
+		studios = append(studios, s)
+	}
+	return studios, rows.Err()
+}
+
+func getStudio(id int) (Studio, error) {
+	var s Studio
+	var aliasesJSON sql.NullString
+	err := db.QueryRow(`
+		SELECT s.id, s.name, s.aliases, (SELECT COUNT(*) FROM galleries g WHERE g.studio_id = s.id)
+		FROM studios s WHERE s.id = ?`, id).Scan(&s.ID, &s.Name, &aliasesJSON, &s.GalleryCount)
+	s.Aliases = parseAliases(aliasesJSON)
+	return s, err
+}
+
+var nonAlnumRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// compactName lower-cases a name and drops everything but letters and
+// digits, so "Met-Art", "Met Art" and "metart.com" all reduce to a prefix of
+// "metartcom".
+func compactName(s string) string {
+	return nonAlnumRe.ReplaceAllString(strings.ToLower(s), "")
+}
+
+// detectStudio finds the studio a gallery belongs to. The studio part parsed
+// from the title by the name extractor must match a name or alias exactly;
+// otherwise the longest name or alias found as a whole word in the title, or
+// inside the URL, wins. Short names are only matched exactly to avoid
+// three-letter aliases matching random words.
+func detectStudio(studios []Studio, in NameInput, titleStudio string) (Studio, bool) {
+	if titleStudio != "" {
+		want := compactName(titleStudio)
+		for _, s := range studios {
+			for _, n := range append([]string{s.Name}, s.Aliases...) {
+				if compactName(n) == want {
+					return s, true
+				}
+			}
+		}
+	}
+
+	title := " " + nonAlnumRe.ReplaceAllString(strings.ToLower(in.ThreadTitle), " ") + " "
+	compactURL := compactName(in.URL)
+	var best Studio
+	bestLen := 0
+	for _, s := range studios {
+		for _, n := range append([]string{s.Name}, s.Aliases...) {
+			words := strings.TrimSpace(nonAlnumRe.ReplaceAllString(strings.ToLower(n), " "))
+			compact := compactName(n)
+			if len(compact) < 4 || len(compact) <= bestLen {
+				continue
+			}
+			if strings.Contains(title, " "+words+" ") || strings.Contains(compactURL, compact) {
+				best, bestLen = s, len(compact)
+			}
+		}
+	}
+	return best, bestLen > 0
+}
+
+// titleStudio is the studio part of a title-rules name, if any. It skips the
+// rest of the extractor chain, which may call out over HTTP.
+func titleStudio(in NameInput) string {
+	name, err := titleRulesExtractor{}.Extract(in)
+	if err != nil {
+		return ""
+	}
+	return name.Studio
+}
+
+// assignStudio sets the studio of the request's gallery if it has none yet.
+func assignStudio(requestID int, in NameInput) error {
+	var studioID sql.NullInt64
+	if err := db.QueryRow("SELECT studio_id FROM galleries WHERE request_id = ?", requestID).Scan(&studioID); err != nil {
+		return fmt.Errorf("querying gallery for request %d: %v", requestID, err)
+	}
+	if studioID.Valid {
+		return nil
+	}
+	studios, err := loadStudios()
+	if err != nil {
+		return err
+	}
+	s, ok := detectStudio(studios, in, titleStudio(in))
+	if !ok {
+		return nil
+	}
+	if _, err := execWithRetry("UPDATE galleries SET studio_id = ? WHERE request_id = ?", s.ID, requestID); err != nil {
+		return fmt.Errorf("assigning studio to request %d: %v", requestID, err)
+	}
+	log.Printf("Assigned studio %s to gallery of request %d", s.Name, requestID)
+	return nil
+}
+
+type studioRequest struct {
+	Name    string   `json:"name" binding:"required"`
+	Aliases []string `json:"aliases"`
+}
+
+func listStudios(c *gin.Context) {
+	studios, err := loadStudios()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, studios)
+}
+
+func getStudioHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid studio ID"})
+		return
+	}
+	s, err := getStudio(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Studio not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func addStudio(c *gin.Context) {
+	var req studioRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if req.Aliases == nil {
+		req.Aliases = []string{}
+	}
+	aliasesJSON, err := json.Marshal(req.Aliases)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode aliases"})
+		return
+	}
+	result, err := execWithRetry("INSERT INTO studios (name, aliases) VALUES (?, ?)", strings.TrimSpace(req.Name), string(aliasesJSON))
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to add studio: " + err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get studio ID"})
+		return
+	}
+	c.JSON(http.StatusOK, Studio{ID: int(id), Name: strings.TrimSpace(req.Name), Aliases: req.Aliases})
+}
+
+func updateStudio(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid studio ID"})
+		return
+	}
+	var req studioRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if req.Aliases == nil {
+		req.Aliases = []string{}
+	}
+	aliasesJSON, err := json.Marshal(req.Aliases)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode aliases"})
+		return
+	}
+	result, err := execWithRetry("UPDATE studios SET name = ?, aliases = ? WHERE id = ?", strings.TrimSpace(req.Name), string(aliasesJSON), id)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to update studio: " + err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Studio not found"})
+		return
+	}
+	s, err := getStudio(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// deleteStudio removes a studio; its galleries are kept without a studio.
+func deleteStudio(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid studio ID"})
+		return
+	}
+	if _, err := execWithRetry("UPDATE galleries SET studio_id = NULL WHERE studio_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := execWithRetry("DELETE FROM studios WHERE id = ?", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Studio not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Studio deleted"})
+}
+
+// detectStudios assigns studios to every gallery that has none, e.g. after
+// adding a studio or an alias.
+func detectStudios(c *gin.Context) {
+	studios, err := loadStudios()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := db.Query(`SELECT g.id, r.url, g.thread_title FROM galleries g
+		JOIN requests r ON g.request_id = r.id WHERE g.studio_id IS NULL`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	type match struct{ galleryID, studioID int }
+	var matches []match
+	for rows.Next() {
+		var galleryID int
+		var in NameInput
+		var title sql.NullString
+		if err := rows.Scan(&galleryID, &in.URL, &title); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		in.ThreadTitle = title.String
+		if s, ok := detectStudio(studios, in, titleStudio(in)); ok {
+			matches = append(matches, match{galleryID, s.ID})
+		}
+	}
+	rows.Close()
+
+	for _, m := range matches {
+		if _, err := execWithRetry("UPDATE galleries SET studio_id = ? WHERE id = ?", m.studioID, m.galleryID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"assigned": len(matches)})
+}
+
+// setGalleryStudio assigns a studio by hand; a null studioId clears it.
+func setGalleryStudio(c *gin.Context) {
+	galleryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gallery id"})
+		return
+	}
+	var req struct {
+		StudioID *int `json:"studioId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if req.StudioID != nil {
+		if _, err := getStudio(*req.StudioID); err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Studio not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if _, err := execWithRetry("UPDATE galleries SET studio_id = ? WHERE id = ?", req.StudioID, galleryID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update gallery: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Gallery updated"})
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestDetectStudio(t *testing.T) {
+	studios := []Studio{
+		{ID: 1, Name: "Met Art", Aliases: []string{"MetArt", "metart.com"}},
+		{ID: 2, Name: "Met Art X", Aliases: []string{"MAX"}},
+		{ID: 3, Name: "Sunset Studio"},
+	}
+	tests := []struct {
+		name   string
+		in     NameInput
+		wantID int
+	}{
+		{
+			name:   "studio part of title rules matches an alias exactly",
+			in:     NameInput{ThreadTitle: "MAX - Jane Doe - Beach Day"},
+			wantID: 2,
+		},
+		{
+			name:   "longest name found as whole words wins",
+			in:     NameInput{ThreadTitle: "Jane Doe for Met Art X: Beach Day"},
+			wantID: 2,
+		},
+		{
+			name:   "alias spelled differently",
+			in:     NameInput{ThreadTitle: "Jane Doe (MET-ART) Beach Day"},
+			wantID: 1,
+		},
+		{
+			name:   "name inside the URL",
+			in:     NameInput{URL: "https://forum.example.com/threads/sunsetstudio-jane-doe.123/", ThreadTitle: "Jane Doe"},
+			wantID: 3,
+		},
+		{
+			name:   "short alias is not matched as a word",
+			in:     NameInput{ThreadTitle: "Jane Doe max resolution set"},
+			wantID: 0,
+		},
+		{
+			name:   "name only as part of a word",
+			in:     NameInput{ThreadTitle: "Sunset Studios presents Jane"},
+			wantID: 0,
+		},
+		{
+			name:   "unknown studio part falls back to the title",
+			in:     NameInput{ThreadTitle: "Other Site - Jane Doe - Met Art Beach"},
+			wantID: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ok := detectStudio(studios, tt.in, titleStudio(tt.in))
+			if ok != (tt.wantID != 0) || s.ID != tt.wantID {
+				t.Errorf("detectStudio = %d, %v; want %d", s.ID, ok, tt.wantID)
+			}
+		})
+	}
+}
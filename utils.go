@@ -1,15 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/gocolly/colly/v2"
 )
 
 func sanitizeFolderName(name string) string {
@@ -21,42 +22,178 @@ func sanitizeFolderName(name string) string {
 	return sanitizedName
 }
 
-func DownloadFile(url, path string) error {
+// hostOf returns the lower-cased host name of a URL, or "" if it does not parse.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// downloadClient fetches image files. It has no overall timeout so large
+// files can finish; stalled connections are caught by the transport.
+var downloadClient = newHTTPClient(0)
+
+// partSuffix marks a download in progress. The file is only renamed to its
+// final path once it is complete, so a partial file is never mistaken for a
+// downloaded one.
+const partSuffix = ".part"
+
+// fileDownloaded reports whether path holds a non-empty file. Zero-byte files
+// left behind by interrupted downloads count as missing.
+func fileDownloaded(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() > 0
+}
+
+// DownloadFile fetches url into path. Data is written to path+".part" and an
+// existing partial file is resumed with a Range request when the server
+// supports it. The file is checked against Content-Length, and a resumed one
+// against the start and total length in Content-Range, and only renamed into
+// place once complete; on error the partial file is kept for the next
+// attempt. It returns the SHA-256 of the completed file.
+func DownloadFile(url, path string) (string, error) {
+	return downloadFile(url, path, true)
+}
+
+// downloadFile is DownloadFile, optionally without segments. A segmented
+// download the server does not serve ranges for is retried in one piece.
+func downloadFile(url, path string, segmented bool) (string, error) {
 	fmt.Printf("Starting download of %s to %s\n", url, path)
 
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("creating directory %s: %v", dir, err)
+		return "", fmt.Errorf("creating directory %s: %v", dir, err)
 	}
-	fmt.Printf("Ensured directory %s exists\n", dir)
 
-	out, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("creating file %s: %v", path, err)
+	partPath := path + partSuffix
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
 	}
-	defer out.Close()
-	fmt.Printf("Created file %s\n", path)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating request for %s: %v", url, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		fmt.Printf("Resuming %s at byte %d\n", url, offset)
+	}
+	resp, err := downloadClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("fetching %s: %v", url, err)
+		return "", fmt.Errorf("fetching %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 	fmt.Printf("HTTP response for %s: Status %s\n", url, resp.Status)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %s for %s", resp.Status, url)
+	flags := os.O_CREATE | os.O_WRONLY
+	total := int64(-1) // full size from Content-Range, when resuming
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		var ok bool
+		start, total, ok = parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(partPath)
+			return "", fmt.Errorf("unexpected Content-Range %q resuming %s at %d", resp.Header.Get("Content-Range"), url, offset)
+		}
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file may already hold everything.
+		if _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && total == offset {
+			return finishDownload(partPath, path, "")
+		}
+		os.Remove(partPath)
+		return "", fmt.Errorf("cannot resume %s at byte %d: %s", url, offset, resp.Status)
+	case resp.StatusCode == http.StatusOK:
+		if segments := segmentsFor(resp); segmented && offset == 0 && segments > 1 {
+			sum, err := downloadSegmented(url, path, resp, segments)
+			if errors.Is(err, errRangeIgnored) {
+				fmt.Printf("Falling back to a single connection for %s: %v\n", url, err)
+				return downloadFile(url, path, false)
+			}
+			return sum, err
+		}
+		// Range not supported (or nothing to resume): start over.
+		offset = 0
+		flags |= os.O_TRUNC
+	default:
+		return "", fmt.Errorf("unexpected status %s for %s", resp.Status, url)
 	}
 
-	_, err = io.Copy(out, resp.Body)
+	out, err := os.OpenFile(partPath, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("writing to %s: %v", path, err)
+		return "", fmt.Errorf("creating file %s: %v", partPath, err)
+	}
+	written, err := io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("writing to %s: %v", partPath, err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return "", fmt.Errorf("short download of %s: got %d of %d bytes", url, written, resp.ContentLength)
+	}
+	if total >= 0 && offset+written != total {
+		// The server's idea of the file does not match what we hold.
+		os.Remove(partPath)
+		return "", fmt.Errorf("resumed download of %s has %d bytes, Content-Range says %d", url, offset+written, total)
+	}
+	if offset+written == 0 {
+		os.Remove(partPath)
+		return "", fmt.Errorf("empty response for %s", url)
+	}
+	return finishDownload(partPath, path, resp.Header.Get("Content-Type"))
+}
+
+// finishDownload validates a completed partial file and moves it into place,
+// returning its SHA-256. Invalid content is deleted rather than kept for
+// resuming.
+func finishDownload(partPath, path, contentType string) (string, error) {
+	sum, err := validateDownload(partPath, contentType)
+	if err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return "", fmt.Errorf("renaming %s to %s: %v", partPath, path, err)
 	}
 	fmt.Printf("Completed writing to %s\n", path)
-	return nil
+	return sum, nil
 }
 
-func newCollector() *colly.Collector {
-	fmt.Println("Creating new Colly collector")
-	return colly.NewCollector()
+// parseContentRange parses "bytes start-end/total" and "bytes */total". The
+// start is -1 for the latter and total is -1 when the server sends "*".
+func parseContentRange(header string) (start, total int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total = n
+	}
+	if rng == "*" {
+		return -1, total, true
+	}
+	first, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
 }
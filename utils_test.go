@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header string
+		start  int64
+		total  int64
+		ok     bool
+	}{
+		{"bytes 0-99/1000", 0, 1000, true},
+		{"bytes 500-999/1000", 500, 1000, true},
+		{" bytes 100-199/* ", 100, -1, true},
+		{"bytes */1000", -1, 1000, true},
+		{"bytes */*", -1, -1, true},
+		{"", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"bytes 0-99", 0, 0, false},
+		{"bytes 0-99/abc", 0, 0, false},
+		{"bytes x-99/1000", 0, 0, false},
+		{"bytes 100/1000", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, total, ok := parseContentRange(tt.header)
+		if ok != tt.ok || (ok && (start != tt.start || total != tt.total)) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v; want %d, %d, %v",
+				tt.header, start, total, ok, tt.start, tt.total, tt.ok)
+		}
+	}
+}
+
+// testPNG encodes a w×h image of noise, which does not compress, so the file
+// is large enough to split.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(img.Pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	data := testPNG(t, 64, 64)
+	const have = 1000
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		wantErr bool
+	}{
+		{
+			name: "server honours the range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if got, want := r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", have); got != want {
+					t.Errorf("Range = %q, want %q", got, want)
+				}
+				http.ServeContent(w, r, "image.png", time.Time{}, bytes.NewReader(data))
+			},
+		},
+		{
+			name: "server ignores the start offset",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data)
+			},
+			wantErr: true,
+		},
+		{
+			name: "total length disagrees with the partial file",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", have, len(data)-1, len(data)+10))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data[have:])
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(tt.handler))
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "image.png")
+			if err := os.WriteFile(path+partSuffix, data[:have], 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := DownloadFile(srv.URL+"/image.png", path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFile error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(path + partSuffix); !os.IsNotExist(statErr) {
+				t.Errorf("partial file left behind: %v", statErr)
+			}
+			got, readErr := os.ReadFile(path)
+			if tt.wantErr {
+				if readErr == nil {
+					t.Errorf("corrupt download renamed into place")
+				}
+				return
+			}
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("resumed file differs: got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrInvalidContent is returned (wrapped) when a download is not the media
+// it claims to be: an HTML "image removed" page, a file that does not decode,
+// or a known placeholder image. Such files are discarded, never stored.
+var ErrInvalidContent = errors.New("invalid content")
+
+// PlaceholderImage is a known "image not found" picture that hosts serve
+// with status 200 instead of the real image.
+type PlaceholderImage struct {
+	SHA256    string `json:"sha256"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+var (
+	placeholdersMu sync.RWMutex
+	placeholders   = make(map[string]PlaceholderImage)
+)
+
+func loadPlaceholders() error {
+	rows, err := db.Query("SELECT sha256, COALESCE(note, ''), created_at FROM placeholder_images")
+	if err != nil {
+		return fmt.Errorf("querying placeholder images: %v", err)
+	}
+	defer rows.Close()
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+	for rows.Next() {
+		var p PlaceholderImage
+		if err := rows.Scan(&p.SHA256, &p.Note, &p.CreatedAt); err != nil {
+			return fmt.Errorf("scanning placeholder image: %v", err)
+		}
+		placeholders[p.SHA256] = p
+	}
+	return rows.Err()
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validateDownload checks a downloaded file before it is moved into place:
+// the server's Content-Type, the file's magic bytes, the placeholder
+// blocklist and, for still images, a full decode. contentType may be empty.
+// It returns the file's SHA-256, computed for the blocklist anyway.
+func validateDownload(path, contentType string) (string, error) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if strings.HasPrefix(mediaType, "text/") || strings.Contains(mediaType, "json") || strings.Contains(mediaType, "xml") {
+			return "", fmt.Errorf("%w: server sent %s", ErrInvalidContent, mediaType)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	head = head[:n]
+
+	sniffed := http.DetectContentType(head)
+	if isHEIF(head) {
+		sniffed = "image/heif"
+	}
+	isVideo := strings.HasPrefix(sniffed, "video/") || isMP4(head) || isMatroska(head)
+	if !isVideo && !strings.HasPrefix(sniffed, "image/") {
+		return "", fmt.Errorf("%w: file is %s, not an image or video", ErrInvalidContent, sniffed)
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	placeholdersMu.RLock()
+	p, blocked := placeholders[sum]
+	placeholdersMu.RUnlock()
+	if blocked {
+		note := p.Note
+		if note == "" {
+			note = sum
+		}
+		return "", fmt.Errorf("%w: known placeholder image (%s)", ErrInvalidContent, note)
+	}
+
+	// Videos are checked by ffmpeg when the poster is generated, and the
+	// standard decoders do not handle animated WebP.
+	if isVideo || (sniffed == "image/webp" && bytes.Contains(head, []byte("ANIM"))) {
+		return sum, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	// Formats without a registered decoder (HEIC, AVIF, BMP) fail with
+	// image.ErrFormat and are let through unchecked.
+	if _, _, err := image.Decode(f); err != nil && !errors.Is(err, image.ErrFormat) {
+		return "", fmt.Errorf("%w: %s does not decode: %v", ErrInvalidContent, sniffed, err)
+	}
+	return sum, nil
+}
+
+func listPlaceholders(c *gin.Context) {
+	placeholdersMu.RLock()
+	list := make([]PlaceholderImage, 0, len(placeholders))
+	for _, p := range placeholders {
+		list = append(list, p)
+	}
+	placeholdersMu.RUnlock()
+	c.JSON(http.StatusOK, list)
+}
+
+// addPlaceholder blocklists an image by hash, or by the ID of a stored photo
+// that turned out to be a placeholder.
+func addPlaceholder(c *gin.Context) {
+	var req struct {
+		SHA256  string `json:"sha256"`
+		PhotoID int    `json:"photoId"`
+		Note    string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	sum := strings.ToLower(strings.TrimSpace(req.SHA256))
+	if sum == "" && req.PhotoID != 0 {
+		var filePath string
+		var stored sql.NullString
+		err := db.QueryRow("SELECT file_path, sha256 FROM photos WHERE id = ?", req.PhotoID).Scan(&filePath, &stored)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sum = stored.String
+		if sum == "" {
+			if sum, err = fileSHA256(filePath); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide a SHA-256 hex digest or the photoId of a photo"})
+		return
+	}
+	if _, err := execWithRetry("INSERT OR REPLACE INTO placeholder_images (sha256, note) VALUES (?, ?)", sum, req.Note); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p := PlaceholderImage{SHA256: sum, Note: req.Note}
+	if err := db.QueryRow("SELECT created_at FROM placeholder_images WHERE sha256 = ?", sum).Scan(&p.CreatedAt); err != nil {
+		log.Printf("Error reading placeholder %s: %v", sum, err)
+	}
+	placeholdersMu.Lock()
+	placeholders[sum] = p
+	placeholdersMu.Unlock()
+	c.JSON(http.StatusOK, p)
+}
+
+func deletePlaceholder(c *gin.Context) {
+	sum := strings.ToLower(c.Param("sha256"))
+	if _, err := execWithRetry("DELETE FROM placeholder_images WHERE sha256 = ?", sum); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	placeholdersMu.Lock()
+	delete(placeholders, sum)
+	placeholdersMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Placeholder deleted"})
+}
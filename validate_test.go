@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateDownload(t *testing.T) {
+	valid := testPNG(t, 32, 32)
+	placeholder := testPNG(t, 16, 16)
+	digest := sha256.Sum256(placeholder)
+	sum := hex.EncodeToString(digest[:])
+	placeholdersMu.Lock()
+	placeholders[sum] = PlaceholderImage{SHA256: sum, Note: "test placeholder"}
+	placeholdersMu.Unlock()
+	t.Cleanup(func() {
+		placeholdersMu.Lock()
+		delete(placeholders, sum)
+		placeholdersMu.Unlock()
+	})
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		wantErr     bool
+	}{
+		{name: "valid image", data: valid, contentType: "image/png"},
+		{name: "valid image without content type", data: valid},
+		{name: "truncated image", data: valid[:len(valid)/2], contentType: "image/png", wantErr: true},
+		{
+			name:        "HTML error page saved as .jpg",
+			data:        []byte("<!DOCTYPE html><html><body><h1>Image not found</h1></body></html>"),
+			contentType: "image/jpeg",
+			wantErr:     true,
+		},
+		{name: "server says text/html", data: valid, contentType: "text/html; charset=utf-8", wantErr: true},
+		{name: "blocklisted placeholder", data: placeholder, contentType: "image/png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image.jpg")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := validateDownload(path, tt.contentType)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidContent) {
+					t.Fatalf("validateDownload error = %v, want ErrInvalidContent", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateDownload error = %v", err)
+			}
+			if want := sha256.Sum256(tt.data); got != hex.EncodeToString(want[:]) {
+				t.Errorf("validateDownload = %s, want the file's SHA-256", got)
+			}
+		})
+	}
+}
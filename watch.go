@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultWatchIntervalMinutes = 60
+	// maxWatchPagesPerPoll bounds how far a single poll walks past the last
+	// page it saw, so a watch on a huge thread catches up over several polls.
+	maxWatchPagesPerPoll = 20
+)
+
+// ThreadWatch is a followed thread that is re-polled for new posts.
+type ThreadWatch struct {
+	ID                  int    `json:"id"`
+	URL                 string `json:"url"`
+	LastPostID          string `json:"lastPostId,omitempty"`
+	LastPage            int    `json:"lastPage"`
+	PollIntervalMinutes int    `json:"pollIntervalMinutes"`
+	Enabled             bool   `json:"enabled"`
+	LastCheckedAt       string `json:"lastCheckedAt,omitempty"`
+	LastError           string `json:"lastError,omitempty"`
+	CreatedAt           string `json:"createdAt"`
+}
+
+var postNumberRe = regexp.MustCompile(`\d+`)
+
+// postNumber extracts the numeric part of a post id. Forum post ids grow
+// monotonically, so it orders posts across pages.
+func postNumber(postID string) int64 {
+	matches := postNumberRe.FindAllString(postID, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(matches[len(matches)-1], 10, 64)
+	return n
+}
+
+const watchColumns = `id, url, last_post_id, last_page, poll_interval_minutes, enabled, last_checked_at, last_error, created_at`
+
+func scanWatch(scan func(dest ...interface{}) error) (ThreadWatch, error) {
+	var w ThreadWatch
+	var lastPostID, lastChecked, lastError sql.NullString
+	if err := scan(&w.ID, &w.URL, &lastPostID, &w.LastPage, &w.PollIntervalMinutes, &w.Enabled, &lastChecked, &lastError, &w.CreatedAt); err != nil {
+		return w, err
+	}
+	w.LastPostID = lastPostID.String
+	w.LastCheckedAt = lastChecked.String
+	w.LastError = lastError.String
+	return w, nil
+}
+
+func getWatch(id int) (ThreadWatch, error) {
+	return scanWatch(db.QueryRow(`SELECT `+watchColumns+` FROM thread_watches WHERE id = ?`, id).Scan)
+}
+
+// pollWatch walks the thread from the last page it saw and queues every post
+// newer than the last seen post. With queue=false it only records the current
+// position, which is how a watch starts without backfilling old posts.
+func pollWatch(w ThreadWatch, queue bool) (int, error) {
+	newest := postNumber(w.LastPostID)
+	newestID := w.LastPostID
+	queued := 0
+
+	// Start from the last page we saw; the enumerator reads the current page
+	// count from the pagination control and stops there.
+	start := w.LastPage
+	if !queue {
+		// Nothing is queued, so there is no need to walk the old pages: read
+		// the first page for the page count and start from the end.
+		probe := &ThreadEnumerator{MaxPages: 1, OnPost: func(ForumPost) error { return nil }}
+		if err := probe.Run(w.URL); err == nil && probe.PageCount > start {
+			start = probe.PageCount
+		}
+	}
+	enumerator := &ThreadEnumerator{
+		StartPage: start,
+		MaxPages:  maxWatchPagesPerPoll,
+		OnPost: func(post ForumPost) error {
+			n := postNumber(post.ID)
+			if n <= newest {
+				return nil
+			}
+			// A post that could not be queued stops the poll before it is
+			// marked as seen, so the next poll tries it again.
+			if queue {
+				ok, err := queueRequest(post.URL)
+				if err != nil {
+					return err
+				}
+				if ok {
+					queued++
+				}
+			}
+			newest, newestID = n, post.ID
+			return nil
+		},
+	}
+	pollErr := enumerator.Run(w.URL)
+	lastPage := w.LastPage
+	if enumerator.LastPage > lastPage {
+		lastPage = enumerator.LastPage
+	}
+
+	errText := ""
+	if pollErr != nil {
+		errText = pollErr.Error()
+	}
+	_, err := execWithRetry(`
+		UPDATE thread_watches
+		SET last_post_id = ?, last_page = ?, last_checked_at = CURRENT_TIMESTAMP, last_error = ?
+		WHERE id = ?`, newestID, lastPage, errText, w.ID)
+	if err != nil {
+		return queued, fmt.Errorf("updating watch %d: %v", w.ID, err)
+	}
+	if queued > 0 {
+		log.Printf("Watch %d queued %d new posts from %s", w.ID, queued, w.URL)
+	}
+	return queued, pollErr
+}
+
+// threadWatchService polls every enabled watch whose interval has elapsed.
+func threadWatchService() {
+	for {
+		rows, err := db.Query(`SELECT ` + watchColumns + ` FROM thread_watches
+			WHERE enabled = 1
+			  AND (last_checked_at IS NULL
+			       OR datetime(last_checked_at, '+' || poll_interval_minutes || ' minutes') <= CURRENT_TIMESTAMP)`)
+		if err != nil {
+			log.Printf("Error querying thread watches: %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		var due []ThreadWatch
+		for rows.Next() {
+			w, err := scanWatch(rows.Scan)
+			if err != nil {
+				log.Printf("Error scanning thread watch: %v", err)
+				continue
+			}
+			due = append(due, w)
+		}
+		rows.Close()
+
+		for _, w := range due {
+			if _, err := pollWatch(w, true); err != nil {
+				log.Printf("Polling watch %d (%s) failed: %v", w.ID, w.URL, err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+func watchThread(c *gin.Context) {
+	var req struct {
+		URL                 string `json:"url" binding:"required"`
+		PollIntervalMinutes int    `json:"pollIntervalMinutes"`
+		Backfill            bool   `json:"backfill"` // queue existing posts too
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if req.PollIntervalMinutes <= 0 {
+		req.PollIntervalMinutes = defaultWatchIntervalMinutes
+	}
+	threadURL := sourceFor(req.URL).ThreadURL(req.URL)
+
+	// The watch counts as checked from the start so the scheduler leaves it
+	// to the initial poll below.
+	res, err := db.Exec(`INSERT INTO thread_watches (url, poll_interval_minutes, last_checked_at) VALUES (?, ?, CURRENT_TIMESTAMP)`,
+		threadURL, req.PollIntervalMinutes)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to add watch: " + err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	w, err := getWatch(int(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Establish the starting point in the background so the scheduler only
+	// picks up posts made after subscribing (unless backfill was requested).
+	// The outcome is recorded on the watch.
+	go func() {
+		if _, err := pollWatch(w, req.Backfill); err != nil {
+			log.Printf("Initial poll of watch %d failed: %v", w.ID, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"watch": w, "message": "Initial poll started"})
+}
+
+func listWatches(c *gin.Context) {
+	rows, err := db.Query(`SELECT ` + watchColumns + ` FROM thread_watches ORDER BY id`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	watches := []ThreadWatch{}
+	for rows.Next() {
+		w, err := scanWatch(rows.Scan)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		watches = append(watches, w)
+	}
+	c.JSON(http.StatusOK, watches)
+}
+
+func updateWatch(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid watch ID"})
+		return
+	}
+	var req struct {
+		Enabled             *bool `json:"enabled"`
+		PollIntervalMinutes *int  `json:"pollIntervalMinutes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if req.Enabled != nil {
+		if _, err := execWithRetry("UPDATE thread_watches SET enabled = ? WHERE id = ?", *req.Enabled, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.PollIntervalMinutes != nil && *req.PollIntervalMinutes > 0 {
+		if _, err := execWithRetry("UPDATE thread_watches SET poll_interval_minutes = ? WHERE id = ?", *req.PollIntervalMinutes, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	w, err := getWatch(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Watch not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func deleteWatch(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid watch ID"})
+		return
+	}
+	if _, err := execWithRetry("DELETE FROM thread_watches WHERE id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Watch deleted"})
+}
+
+func pollWatchNow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid watch ID"})
+		return
+	}
+	w, err := getWatch(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Watch not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	queued, err := pollWatch(w, true)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "queued": queued})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"queued": queued})
+}